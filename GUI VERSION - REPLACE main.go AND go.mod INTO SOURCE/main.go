@@ -71,10 +71,12 @@ func (w *LogWriter) GetText() string {
 
 // AppState 应用状态管理
 type AppState struct {
-	mu      sync.RWMutex
-	running bool
-	runner  *core.Runner
-	hm      *core.HistoryManager
+	mu       sync.RWMutex
+	running  bool
+	runner   *core.Runner
+	hm       *core.HistoryManager
+	stopping sync.WaitGroup // 停止按钮发起、尚未完成的停止
+	closing  bool           // 已点击关闭, 正在停止并保存历史
 }
 
 func (s *AppState) IsRunning() bool {
@@ -221,7 +223,27 @@ func main() {
 		}
 		// 保存后切换回预览模式
 		switchToPreview()
-		dialog.ShowInformation("保存成功", "配置已保存，需要重启传输任务才能生效。", myWindow)
+
+		state.mu.RLock()
+		runner := state.runner
+		state.mu.RUnlock()
+		if runner == nil {
+			dialog.ShowInformation("保存成功", "配置已保存，将在启动任务时生效。", myWindow)
+			return
+		}
+
+		// 任务运行中: 直接应用新配置, 未改动的任务不受影响
+		cfg, err := config.LoadConfig(configPath)
+		if err == nil {
+			err = runner.Reload(cfg)
+		}
+		if err != nil {
+			log.Printf("重新加载配置失败, 继续使用原配置: %v", err)
+			dialog.ShowError(fmt.Errorf("配置已保存，但未能应用，任务继续使用原配置: %v", err), myWindow)
+			return
+		}
+		log.Println("配置已重新加载")
+		dialog.ShowInformation("保存成功", "配置已保存并已应用到运行中的任务。", myWindow)
 	})
 
 	// 提示标签
@@ -327,8 +349,12 @@ func main() {
 		state.hm = nil
 		state.mu.Unlock()
 
+		statusLabel.SetText("状态: 正在停止...")
+
+		state.stopping.Add(1)
 		go func() {
-			log.Println("正在停止...")
+			defer state.stopping.Done()
+			log.Println("正在停止, 等待进行中的传输完成...")
 			if runner != nil {
 				runner.Stop()
 			}
@@ -368,18 +394,37 @@ func main() {
 	myWindow.SetContent(split)
 	myWindow.Resize(fyne.NewSize(1200, 700))
 
-	myWindow.SetOnClosed(func() {
+	// 停止可能要等待宽限期, 不能阻塞界面; 停止完成并保存历史后再关闭窗口
+	myWindow.SetCloseIntercept(func() {
 		state.mu.Lock()
+		if state.closing {
+			// 第一次关闭还在停止和保存, 完成后会关闭窗口
+			state.mu.Unlock()
+			return
+		}
+		state.closing = true
 		runner := state.runner
 		hm := state.hm
+		state.running = false
+		state.runner = nil
+		state.hm = nil
 		state.mu.Unlock()
 
-		if runner != nil {
-			runner.Stop()
-		}
-		if hm != nil {
-			hm.Save()
-		}
+		startBtn.Disable()
+		stopBtn.Disable()
+		statusLabel.SetText("状态: 正在停止, 完成后关闭窗口...")
+
+		go func() {
+			if runner != nil {
+				log.Println("正在停止, 等待进行中的传输完成...")
+				runner.Stop()
+			}
+			if hm != nil {
+				hm.Save()
+			}
+			state.stopping.Wait()
+			fyne.Do(myWindow.Close)
+		}()
 	})
 
 	myWindow.ShowAndRun()
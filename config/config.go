@@ -1,26 +1,100 @@
 package config
 
 import (
+	"errors"
 	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/pelletier/go-toml/v2"
 )
 
 type Config struct {
-	Tasks []Task `toml:"tasks"`
+	MaxBandwidth     ByteSize          `toml:"max_bandwidth"`     // 全局带宽上限 (字节/秒), 所有任务共享, 如 "10MB"
+	BandwidthWindows []BandwidthWindow `toml:"bandwidth_windows"` // 全局分时段带宽
+	ShutdownGrace    Duration          `toml:"shutdown_grace"`    // 停止时等待进行中的传输完成的时间, 超时则中断, 默认 "30s"
+	Tasks            []Task            `toml:"tasks"`
+}
+
+// BandwidthWindow replaces max_bandwidth between From and To, local time.
+type BandwidthWindow struct {
+	From         string   `toml:"from"`          // 如 "08:00"
+	To           string   `toml:"to"`            // 如 "18:00", 早于 from 时跨午夜
+	MaxBandwidth ByteSize `toml:"max_bandwidth"` // 该时段的上限, 0 为不限速
 }
 
 type Task struct {
-	Name           string `toml:"name"`
-	Cron           string `toml:"cron"`
-	SourceType     string `toml:"source_type"` // local, sftp, ftp
-	SourcePath     string `toml:"source_path"`
-	SourceRegex    string `toml:"source_regex"`
-	TargetType     string `toml:"target_type"` // local, sftp, ftp
+	Name                string   `toml:"name"`
+	Cron                string   `toml:"cron"`
+	Overlap             string   `toml:"overlap"`     // 上一次运行未结束时: skip (默认, 跳过本次), queue (排队等待, 最多一次), allow (允许并行)
+	SourceType          string   `toml:"source_type"` // local, sftp, ftp, ftps, s3, webdav
+	SourcePath          string   `toml:"source_path"`
+	SourceRegex         string   `toml:"source_regex"`
+	Include             []string `toml:"include"`           // 相对路径包含规则 (任一匹配), doublestar 通配如 "reports/**/*.csv", 或 "re:" 前缀的正则
+	Exclude             []string `toml:"exclude"`           // 相对路径排除规则, 格式同 include; 匹配的目录整体跳过不再遍历, 如 "**/tmp"
+	MinSize             ByteSize `toml:"min_size"`          // 文件大小下限, 如 "1KB", "10MB" (MB=1000*1000, MiB=1024*1024)
+	MaxSize             ByteSize `toml:"max_size"`          // 文件大小上限, 格式同 min_size
+	MaxFilesPerRun      int      `toml:"max_files_per_run"` // 每次运行最多传输文件数 (默认不限)
+	MaxBytesPerRun      ByteSize `toml:"max_bytes_per_run"` // 每次运行最多传输字节数, 至少传输一个文件 (默认不限)
+	Order               string   `toml:"order"`             // 传输顺序: oldest_first, newest_first, name, smallest_first (默认按列表顺序)
+	MaxDepth            int      `toml:"max_depth"`         // 最大遍历深度, 1 为仅根目录 (默认不限)
+	TargetType          string   `toml:"target_type"`       // local, sftp, ftp, ftps, s3, webdav
+	TargetPath          string   `toml:"target_path"`
+	TargetTemplate      string   `toml:"target_template"`       // 目标相对路径模板, 如 "{yyyy}/{MM}/{dd}/{task}/{name}" (默认与源相对路径相同)
+	OnConflict          string   `toml:"on_conflict"`           // 目标文件已存在时: overwrite (默认), skip, rename, fail, overwrite_if_newer
+	ConflictSuffix      string   `toml:"conflict_suffix"`       // rename 模式的后缀: number (默认, 如 a_1.csv), timestamp (如 a_20240131-150405.csv)
+	RetentionDays       int      `toml:"retention_days"`        // 清理多少天之前的文件
+	SourceNewerDays     int      `toml:"source_newer_days"`     // 仅遍历多少天内的文件
+	AtomicWrite         bool     `toml:"atomic_write"`          // 先写临时文件, 传输完成后再重命名为目标文件名
+	TempPrefix          string   `toml:"temp_prefix"`           // 临时文件名前缀
+	TempSuffix          string   `toml:"temp_suffix"`           // 临时文件名后缀 (前后缀都为空时默认 .part)
+	Resume              bool     `toml:"resume"`                // 断点续传: 目标存在不完整文件(或临时文件)时从断点处追加
+	Verify              string   `toml:"verify"`                // 传输后校验: size, md5, sha256 (默认不校验)
+	Concurrency         int      `toml:"concurrency"`           // 并发传输文件数, 每个并发使用独立连接 (默认 1)
+	SourceAfterTransfer string   `toml:"source_after_transfer"` // 传输成功后源文件处理: keep (默认), delete, move
+	SourceArchiveDir    string   `toml:"source_archive_dir"`    // move 模式下的归档目录, 相对于 source_path (默认 archive)
+	Mode                string   `toml:"mode"`                  // copy (默认), mirror (目标与源保持一致, 删除源中已不存在的文件)
+	MirrorMaxDeletions  int      `toml:"mirror_max_deletions"`  // mirror 单次最多删除文件数, 超过则本次不删除 (默认 100, -1 不限制)
+	ChangeDetection     string   `toml:"change_detection"`      // 已传输文件的变更检测: name (默认, 只传一次), size_mtime, hash
+	StableFor           Duration `toml:"stable_for"`            // 文件大小和修改时间需保持不变的时长 (跨两次扫描), 如 "2m"
+	MinAge              Duration `toml:"min_age"`               // 或修改时间距今至少多久才传输, 如 "10m"
+	SourceMarker        string   `toml:"source_marker"`         // 标记文件存在时才传输, 如 "{name}.ok", "{stem}.done"; 不含占位符 (如 "_SUCCESS") 时对整个目录生效
+	TargetMarker        string   `toml:"target_marker"`         // 上传成功后在目标写入的空标记文件, 格式同 source_marker; 目录级标记在该目录本次全部成功后写入
+	TargetParallel      bool     `toml:"target_parallel"`       // 多目标时并行写入各目标 (默认依次写入), 源文件都只读取一次
+	SourceAuth          *Auth    `toml:"source_auth,omitempty"`
+	TargetAuth          *Auth    `toml:"target_auth,omitempty"`
+	Targets             []Target `toml:"targets"` // 多个目标 ([[tasks.targets]]), 与 target_type/target_path 二选一
+
+	// 带宽限制
+	MaxBandwidth     ByteSize          `toml:"max_bandwidth"`     // 任务带宽上限 (字节/秒), 并发传输共享, 如 "2MB" (默认不限)
+	BandwidthWindows []BandwidthWindow `toml:"bandwidth_windows"` // 分时段带宽, 如 [{ from = "08:00", to = "18:00", max_bandwidth = "1MB" }]
+
+	// 重试
+	ConnectRetry    RetryPolicy `toml:"connect_retry"`    // 建立连接失败时的重试
+	TransferRetry   RetryPolicy `toml:"transfer_retry"`   // 单个文件传输失败时的重试 (网络类错误会先重新连接)
+	QuarantineAfter int         `toml:"quarantine_after"` // 文件连续多少次运行失败后隔离, 不再重试直到源文件变化 (默认不隔离)
+}
+
+// RetryPolicy controls how often a failing operation is attempted again.
+type RetryPolicy struct {
+	Attempts   int      `toml:"attempts"`    // 总尝试次数 (默认 1, 即不重试)
+	Backoff    Duration `toml:"backoff"`     // 第一次重试前的等待, 之后每次翻倍 (默认 1s)
+	MaxBackoff Duration `toml:"max_backoff"` // 等待上限 (默认 1m)
+	Jitter     float64  `toml:"jitter"`      // 随机抖动比例 0-1, 如 0.2 表示 ±20%
+	RetryOn    []string `toml:"retry_on"`    // 可重试的错误类别: network, timeout, not_found, permission, verify, all (默认 network, timeout)
+}
+
+// Target is one of several destinations of a task. Unset target_template,
+// target_marker and on_conflict fall back to the task's settings.
+type Target struct {
+	Name           string `toml:"name"` // 必填, 任务内唯一, 历史记录按目标分别保存
+	TargetType     string `toml:"target_type"`
 	TargetPath     string `toml:"target_path"`
-	RetentionDays  int    `toml:"retention_days"` // 清理多少天之前的文件
-	SourceNewerDays int   `toml:"source_newer_days"` // 仅遍历多少天内的文件
-	SourceAuth     *Auth  `toml:"source_auth,omitempty"`
+	TargetTemplate string `toml:"target_template"`
+	TargetMarker   string `toml:"target_marker"`
+	OnConflict     string `toml:"on_conflict"`
 	TargetAuth     *Auth  `toml:"target_auth,omitempty"`
 }
 
@@ -29,14 +103,168 @@ type Auth struct {
 	Port     int    `toml:"port"`
 	User     string `toml:"user"`
 	Password string `toml:"password"`
+
+	// SFTP
+	PrivateKey           string   `toml:"private_key"`            // 私钥文件路径 (PEM/OpenSSH)
+	PrivateKeyPassphrase string   `toml:"private_key_passphrase"` // 私钥密码 (可选)
+	UseAgent             bool     `toml:"use_agent"`              // 使用 SSH_AUTH_SOCK 指向的 ssh-agent
+	AuthMethods          []string `toml:"auth_methods"`           // 认证顺序, 默认 publickey, agent, keyboard-interactive, password
+	HostKeyCheck         string   `toml:"host_key_check"`         // tofu (默认), strict, none
+	KnownHosts           string   `toml:"known_hosts"`            // known_hosts 文件; tofu 模式下默认 ./known_hosts
+	HostKeyFingerprints  []string `toml:"host_key_fingerprints"`  // 固定主机指纹, 如 SHA256:xxxx, 优先于 host_key_check
+
+	// S3 (source_path/target_path 为桶内前缀) / WebDAV (source_path/target_path 为共享内路径)
+	Endpoint  string `toml:"endpoint"` // 如 https://minio.local:9000 或 https://cloud.example.com/remote.php/dav/files/user
+	Region    string `toml:"region"`
+	Bucket    string `toml:"bucket"`
+	AccessKey string `toml:"access_key"`
+	SecretKey string `toml:"secret_key"`
+	PathStyle bool   `toml:"path_style"` // MinIO 等通常需要开启
+
+	// WebDAV (user/password 为登录凭据)
+	AuthType string `toml:"auth_type"` // basic, digest (默认自动协商)
+
+	// FTPS (ca_cert, client_cert, client_key, tls_min_version, insecure_skip_verify 也用于 S3/WebDAV 的 https)
+	TLSMode            string `toml:"tls_mode"`        // explicit, implicit (默认 explicit)
+	CACert             string `toml:"ca_cert"`         // 自定义 CA 证书 (PEM)
+	ClientCert         string `toml:"client_cert"`     // 客户端证书 (PEM)
+	ClientKey          string `toml:"client_key"`      // 客户端私钥 (PEM)
+	TLSMinVersion      string `toml:"tls_min_version"` // 1.0, 1.1, 1.2, 1.3 (默认 1.2)
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify"`
 }
 
+// LoadConfig reads and validates the config at path. Keys that do not
+// exist are rejected rather than ignored. A config with mistakes returns a
+// *ValidationError listing all of them with their line and column.
 func LoadConfig(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
+
+	// Decode generically first: only a syntax error stops here, every
+	// other mistake is collected below
+	var doc map[string]any
+	if err := toml.Unmarshal(data, &doc); err != nil {
+		var decodeErr *toml.DecodeError
+		if !errors.As(err, &decodeErr) {
+			return nil, err
+		}
+		line, col := decodeErr.Position()
+		msg := strings.TrimPrefix(decodeErr.Error(), "toml: ")
+		return nil, &ValidationError{File: path, Problems: []Problem{{Line: line, Column: col, Message: msg}}}
+	}
+
+	// Unknown keys and values that do not fit are reported and left out,
+	// so the rest of the config can still be decoded and checked
+	problems := checkKeys(doc, reflect.TypeOf(Config{}), "")
+	clean, err := toml.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
 	var cfg Config
-	err = toml.Unmarshal(data, &cfg)
-	return &cfg, err
+	if err := toml.Unmarshal(clean, &cfg); err != nil {
+		return nil, err
+	}
+
+	// A value left out above is not reported again as missing
+	reported := make(map[string]bool)
+	for _, p := range problems {
+		reported[p.Key] = true
+	}
+	for _, p := range cfg.problems() {
+		if !reported[p.Key] {
+			problems = append(problems, p)
+		}
+	}
+	locate(problems, keyPositions(data))
+	for i := range problems {
+		problems[i].Key = displayKey(problems[i].Key)
+	}
+	if len(problems) > 0 {
+		sort.SliceStable(problems, func(i, j int) bool {
+			if problems[i].Line != problems[j].Line {
+				return problems[i].Line < problems[j].Line
+			}
+			return problems[i].Column < problems[j].Column
+		})
+		return nil, &ValidationError{File: path, Problems: problems}
+	}
+	return &cfg, nil
+}
+
+// checkKeys checks the keys of doc, a table decoded generically, against
+// the fields of the struct type typ, descending into tables and arrays of
+// tables. Keys typ has no field for and values their field cannot hold
+// (a wrong type, a bad size or duration) are reported and removed from doc.
+func checkKeys(doc map[string]any, typ reflect.Type, path string) []Problem {
+	keys := make([]string, 0, len(doc))
+	for key := range doc {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var problems []Problem
+	for _, key := range keys {
+		kpath := joinKey(path, key)
+		field, ok := tomlField(typ, key)
+		if !ok {
+			problems = append(problems, Problem{Key: kpath, Message: "unknown key"})
+			delete(doc, key)
+			continue
+		}
+		ft := field.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		switch value := doc[key].(type) {
+		case map[string]any:
+			if ft.Kind() == reflect.Struct {
+				problems = append(problems, checkKeys(value, ft, kpath)...)
+				continue
+			}
+		case []any:
+			if ft.Kind() == reflect.Slice && ft.Elem().Kind() == reflect.Struct && allTables(value) {
+				for i, elem := range value {
+					problems = append(problems, checkKeys(elem.(map[string]any), ft.Elem(), joinKey(kpath, strconv.Itoa(i)))...)
+				}
+				continue
+			}
+		}
+		if err := decodeValue(typ, key, doc[key]); err != nil {
+			problems = append(problems, Problem{Key: kpath, Message: strings.TrimPrefix(err.Error(), "toml: ")})
+			delete(doc, key)
+		}
+	}
+	return problems
+}
+
+// tomlField returns the field of typ that key decodes into.
+func tomlField(typ reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("toml"), ",")
+		if f.IsExported() && strings.EqualFold(name, key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func allTables(values []any) bool {
+	for _, v := range values {
+		if _, ok := v.(map[string]any); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeValue decodes key = value on its own into a new typ.
+func decodeValue(typ reflect.Type, key string, value any) error {
+	data, err := toml.Marshal(map[string]any{key: value})
+	if err != nil {
+		return err
+	}
+	return toml.Unmarshal(data, reflect.New(typ).Interface())
 }
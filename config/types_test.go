@@ -0,0 +1,55 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestByteSizeUnmarshalText(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    ByteSize
+		wantErr bool
+	}{
+		{in: "0", want: 0},
+		{in: "1024", want: 1024},
+		{in: "10B", want: 10},
+		{in: "1KB", want: 1000},
+		{in: "1k", want: 1000},
+		{in: "10MB", want: 10 * 1000 * 1000},
+		{in: "10 MiB", want: 10 << 20},
+		{in: "1.5GiB", want: 3 << 29},
+		{in: "2tb", want: 2 * 1000 * 1000 * 1000 * 1000},
+		{in: " 5kib ", want: 5 << 10},
+		{in: "", wantErr: true},
+		{in: "MB", wantErr: true},
+		{in: "10XB", wantErr: true},
+		{in: "1.2.3MB", wantErr: true},
+		{in: "-1MB", wantErr: true},
+	}
+	for _, tt := range tests {
+		var got ByteSize
+		err := got.UnmarshalText([]byte(tt.in))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: got %d, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.in, err)
+		} else if got != tt.want {
+			t.Errorf("%q: got %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDurationUnmarshalText(t *testing.T) {
+	var d Duration
+	if err := d.UnmarshalText([]byte("1h30m")); err != nil || time.Duration(d) != 90*time.Minute {
+		t.Errorf("1h30m: got %v, %v", time.Duration(d), err)
+	}
+	if err := d.UnmarshalText([]byte("30")); err == nil {
+		t.Error("30: no error for a duration without unit")
+	}
+}
@@ -0,0 +1,401 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/pelletier/go-toml/v2/unstable"
+	"github.com/robfig/cron/v3"
+)
+
+// Problem is one mistake in a config.
+type Problem struct {
+	Key     string // e.g. "tasks[2].cron", empty if it concerns no single key
+	Line    int    // where in the file, 0 if unknown
+	Column  int
+	Message string
+}
+
+func (p Problem) String() string {
+	var b strings.Builder
+	if p.Line > 0 {
+		fmt.Fprintf(&b, "%d:%d: ", p.Line, p.Column)
+	}
+	if p.Key != "" {
+		b.WriteString(p.Key + ": ")
+	}
+	b.WriteString(p.Message)
+	return b.String()
+}
+
+// ValidationError lists every problem found in a config.
+type ValidationError struct {
+	File     string // empty for a config that did not come from a file
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		lines[i] = p.String()
+		if e.File != "" {
+			lines[i] = e.File + ":" + lines[i]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+var (
+	fsTypes = map[string]bool{"local": true, "sftp": true, "ftp": true, "ftps": true, "s3": true, "webdav": true}
+	// Auth fields each type cannot do without
+	requiredAuth = map[string][]string{
+		"sftp":   {"host", "user"},
+		"ftp":    {"host", "user"},
+		"ftps":   {"host", "user"},
+		"s3":     {"endpoint", "bucket"},
+		"webdav": {"endpoint"},
+	}
+	retryClasses   = []string{"network", "timeout", "not_found", "permission", "verify", "other", "all"}
+	sshAuthMethods = []string{"publickey", "agent", "keyboard-interactive", "password"}
+	tlsVersions    = []string{"1.0", "10", "1.1", "11", "1.2", "12", "1.3", "13"}
+	// Placeholders of source_marker/target_marker
+	markerPlaceholders = strings.NewReplacer("{name}", "", "{stem}", "")
+)
+
+// Validate checks c for mistakes that would otherwise only show up once a
+// task runs. The error is a *ValidationError.
+func (c *Config) Validate() error {
+	return validationError(c.problems())
+}
+
+// Validate checks t on its own, as Config.Validate does for each of its
+// tasks. Keys are relative to the task.
+func (t *Task) Validate() error {
+	var l problemList
+	l.task("", t)
+	return validationError(l)
+}
+
+func validationError(problems []Problem) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	for i := range problems {
+		problems[i].Key = displayKey(problems[i].Key)
+	}
+	return &ValidationError{Problems: problems}
+}
+
+// problems returns c's mistakes, keyed by dotted paths such as
+// "tasks.0.cron".
+func (c *Config) problems() []Problem {
+	var l problemList
+	l.windows("bandwidth_windows", c.BandwidthWindows)
+
+	names := make(map[string]int)
+	for i := range c.Tasks {
+		task := &c.Tasks[i]
+		key := "tasks." + strconv.Itoa(i) + "."
+		if j, ok := names[task.Name]; ok && task.Name != "" {
+			l.add(key+"name", "duplicate task name %q (also tasks[%d])", task.Name, j)
+		} else {
+			names[task.Name] = i
+		}
+		l.task(key, task)
+	}
+	return l
+}
+
+type problemList []Problem
+
+func (l *problemList) add(key, format string, args ...any) {
+	*l = append(*l, Problem{Key: key, Message: fmt.Sprintf(format, args...)})
+}
+
+// oneOf checks that value is empty or one of allowed.
+func (l *problemList) oneOf(key, value string, allowed ...string) {
+	if value == "" || slices.Contains(allowed, value) {
+		return
+	}
+	l.add(key, "unknown value %q, expected %s", value, orList(allowed))
+}
+
+// task checks everything about t; key is its prefix, e.g. "tasks.0.".
+func (l *problemList) task(key string, t *Task) {
+	if t.Name == "" {
+		l.add(key+"name", "required")
+	}
+	if _, err := cron.ParseStandard(t.Cron); err != nil {
+		l.add(key+"cron", "invalid cron %q: %v", t.Cron, err)
+	}
+	l.oneOf(key+"overlap", t.Overlap, "skip", "queue", "allow")
+	l.oneOf(key+"mode", t.Mode, "copy", "mirror")
+	l.oneOf(key+"change_detection", t.ChangeDetection, "name", "size_mtime", "hash")
+	l.oneOf(key+"order", t.Order, "oldest_first", "newest_first", "name", "smallest_first")
+	l.oneOf(key+"verify", t.Verify, "size", "md5", "sha256")
+	l.oneOf(key+"on_conflict", t.OnConflict, "overwrite", "skip", "rename", "fail", "overwrite_if_newer")
+	l.oneOf(key+"conflict_suffix", t.ConflictSuffix, "number", "timestamp")
+	l.oneOf(key+"source_after_transfer", t.SourceAfterTransfer, "keep", "delete", "move")
+	if t.Mode == "mirror" && (t.SourceAfterTransfer == "delete" || t.SourceAfterTransfer == "move") {
+		// Every file taken off the source would be deleted from the target
+		l.add(key+"source_after_transfer", "%s cannot be combined with mode = \"mirror\"", t.SourceAfterTransfer)
+	}
+
+	if _, err := regexp.Compile(t.SourceRegex); err != nil {
+		l.add(key+"source_regex", "invalid regex: %v", err)
+	}
+	l.patterns(key+"include", t.Include)
+	l.patterns(key+"exclude", t.Exclude)
+	l.marker(key+"source_marker", t.SourceMarker)
+	l.marker(key+"target_marker", t.TargetMarker)
+
+	l.endpoint(key, "source", t.SourceType, t.SourcePath, t.SourceAuth)
+	if len(t.Targets) == 0 {
+		l.endpoint(key, "target", t.TargetType, t.TargetPath, t.TargetAuth)
+	} else if t.TargetType != "" || t.TargetPath != "" {
+		l.add(key+"target_type", "cannot be combined with [[tasks.targets]]")
+	}
+	targets := make(map[string]bool)
+	for j, target := range t.Targets {
+		tkey := fmt.Sprintf("%stargets.%d.", key, j)
+		if target.Name == "" {
+			l.add(tkey+"name", "required")
+		} else if targets[target.Name] {
+			l.add(tkey+"name", "duplicate target name %q", target.Name)
+		}
+		targets[target.Name] = true
+		l.endpoint(tkey, "target", target.TargetType, target.TargetPath, target.TargetAuth)
+		l.marker(tkey+"target_marker", target.TargetMarker)
+		l.oneOf(tkey+"on_conflict", target.OnConflict, "overwrite", "skip", "rename", "fail", "overwrite_if_newer")
+	}
+
+	l.windows(key+"bandwidth_windows", t.BandwidthWindows)
+	l.retry(key+"connect_retry", t.ConnectRetry)
+	l.retry(key+"transfer_retry", t.TransferRetry)
+}
+
+func (l *problemList) windows(key string, windows []BandwidthWindow) {
+	for i, w := range windows {
+		for _, t := range []struct{ name, value string }{{"from", w.From}, {"to", w.To}} {
+			if _, err := time.Parse("15:04", t.value); err != nil {
+				l.add(fmt.Sprintf("%s.%d.%s", key, i, t.name), "invalid time of day %q, expected HH:MM", t.value)
+			}
+		}
+	}
+}
+
+// patterns checks include/exclude entries: doublestar globs, or regexps
+// written as "re:<expr>".
+func (l *problemList) patterns(key string, list []string) {
+	for i, s := range list {
+		if expr, ok := strings.CutPrefix(s, "re:"); ok {
+			if _, err := regexp.Compile(expr); err != nil {
+				l.add(fmt.Sprintf("%s.%d", key, i), "invalid regex: %v", err)
+			}
+		} else if !doublestar.ValidatePattern(strings.TrimPrefix(s, "/")) {
+			l.add(fmt.Sprintf("%s.%d", key, i), "invalid glob %q", s)
+		}
+	}
+}
+
+// marker checks a source_marker/target_marker pattern such as "{name}.ok".
+func (l *problemList) marker(key, pattern string) {
+	switch {
+	case pattern == "":
+	case strings.Contains(pattern, "/"):
+		l.add(key, "marker %q must be a file name, not a path", pattern)
+	case markerPlaceholders.Replace(pattern) == "":
+		l.add(key, "marker %q needs a fixed part besides {name}/{stem}", pattern)
+	}
+}
+
+func (l *problemList) retry(key string, p RetryPolicy) {
+	if p.Jitter < 0 || p.Jitter > 1 {
+		l.add(key+".jitter", "must be between 0 and 1")
+	}
+	for i, c := range p.RetryOn {
+		if !slices.Contains(retryClasses, c) {
+			l.add(fmt.Sprintf("%s.retry_on.%d", key, i), "unknown error class %q, expected %s", c, orList(retryClasses))
+		}
+	}
+}
+
+// endpoint checks a source or target; side is "source" or "target".
+func (l *problemList) endpoint(key, side, fsType, path string, auth *Auth) {
+	if fsType == "" {
+		l.add(key+side+"_type", "required")
+		return
+	}
+	if !fsTypes[fsType] {
+		l.add(key+side+"_type", "unknown type %q, expected local, sftp, ftp, ftps, s3 or webdav", fsType)
+		return
+	}
+	if fsType == "local" && path == "" {
+		l.add(key+side+"_path", "required")
+	}
+	fields := requiredAuth[fsType]
+	if len(fields) == 0 {
+		return
+	}
+	if auth == nil {
+		l.add(key+side+"_type", "%s_auth is required for %s", side, fsType)
+		return
+	}
+	akey := key + side + "_auth."
+	values := map[string]string{"host": auth.Host, "user": auth.User, "endpoint": auth.Endpoint, "bucket": auth.Bucket}
+	for _, f := range fields {
+		if values[f] == "" {
+			l.add(akey+f, "required for %s", fsType)
+		}
+	}
+
+	switch fsType {
+	case "sftp":
+		l.oneOf(akey+"host_key_check", auth.HostKeyCheck, "tofu", "strict", "none")
+		for i, m := range auth.AuthMethods {
+			if !slices.Contains(sshAuthMethods, m) {
+				l.add(fmt.Sprintf("%sauth_methods.%d", akey, i), "unknown auth method %q, expected %s", m, orList(sshAuthMethods))
+			}
+		}
+	case "ftps":
+		l.oneOf(akey+"tls_mode", auth.TLSMode, "explicit", "implicit")
+	case "webdav":
+		l.oneOf(akey+"auth_type", strings.ToLower(auth.AuthType), "basic", "digest")
+	}
+	if fsType == "ftps" || fsType == "s3" || fsType == "webdav" {
+		if v := auth.TLSMinVersion; v != "" && !slices.Contains(tlsVersions, strings.TrimPrefix(strings.ToLower(v), "tls")) {
+			l.add(akey+"tls_min_version", "unknown TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", v)
+		}
+	}
+}
+
+// orList joins values as "a, b or c".
+func orList(values []string) string {
+	if len(values) < 2 {
+		return strings.Join(values, "")
+	}
+	return strings.Join(values[:len(values)-1], ", ") + " or " + values[len(values)-1]
+}
+
+// displayKey turns "tasks.0.cron" into "tasks[0].cron".
+func displayKey(key string) string {
+	parts := strings.Split(key, ".")
+	var b strings.Builder
+	for i, p := range parts {
+		if _, err := strconv.Atoi(p); err == nil && i > 0 {
+			b.WriteString("[" + p + "]")
+			continue
+		}
+		if i > 0 {
+			b.WriteString(".")
+		}
+		b.WriteString(p)
+	}
+	return b.String()
+}
+
+// keyPositions maps the dotted path of every table and key in data, with
+// array tables numbered ("tasks.0.cron"), to where it is written.
+func keyPositions(data []byte) map[string]unstable.Position {
+	positions := make(map[string]unstable.Position)
+	counts := make(map[string]int) // elements of each array table so far
+	table := ""
+
+	var p unstable.Parser
+	p.Reset(data)
+	for p.NextExpression() {
+		e := p.Expression()
+		var keys []*unstable.Node
+		for it := e.Key(); it.Next(); {
+			keys = append(keys, it.Node())
+		}
+		if len(keys) == 0 {
+			continue
+		}
+
+		switch e.Kind {
+		case unstable.Table, unstable.ArrayTable:
+			path := ""
+			for i, k := range keys {
+				path = joinKey(path, string(k.Data))
+				if e.Kind == unstable.ArrayTable && i == len(keys)-1 {
+					n := counts[path]
+					counts[path] = n + 1
+					path = joinKey(path, strconv.Itoa(n))
+				} else if n, ok := counts[path]; ok {
+					// The latest element of an array table
+					path = joinKey(path, strconv.Itoa(n-1))
+				}
+			}
+			table = path
+			positions[path] = p.Shape(keys[0].Raw).Start
+		case unstable.KeyValue:
+			path := table
+			for _, k := range keys {
+				path = joinKey(path, string(k.Data))
+			}
+			positions[path] = p.Shape(keys[0].Raw).Start
+			inlinePositions(&p, path, e.Value(), positions)
+		}
+	}
+	return positions
+}
+
+// inlinePositions adds the keys inside value, an inline table or an array
+// of them, to positions.
+func inlinePositions(p *unstable.Parser, path string, value *unstable.Node, positions map[string]unstable.Position) {
+	switch value.Kind {
+	case unstable.InlineTable:
+		for it := value.Children(); it.Next(); {
+			kv := it.Node()
+			key := path
+			var first *unstable.Node
+			for k := kv.Key(); k.Next(); {
+				if first == nil {
+					first = k.Node()
+				}
+				key = joinKey(key, string(k.Node().Data))
+			}
+			if first == nil {
+				continue
+			}
+			positions[key] = p.Shape(first.Raw).Start
+			inlinePositions(p, key, kv.Value(), positions)
+		}
+	case unstable.Array:
+		i := 0
+		for it := value.Children(); it.Next(); i++ {
+			inlinePositions(p, joinKey(path, strconv.Itoa(i)), it.Node(), positions)
+		}
+	}
+}
+
+func joinKey(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// locate sets the position of each problem to that of its key, or of the
+// nearest enclosing table or key that is written out.
+func locate(problems []Problem, positions map[string]unstable.Position) {
+	for i := range problems {
+		p := &problems[i]
+		for key := p.Key; key != "" && p.Line == 0; {
+			if pos, ok := positions[key]; ok {
+				p.Line, p.Column = pos.Line, pos.Column
+			}
+			j := strings.LastIndexByte(key, '.')
+			if j < 0 {
+				break
+			}
+			key = key[:j]
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// validTask returns a task that passes validation, for tests to break.
+func validTask() Task {
+	return Task{
+		Name:       "t",
+		Cron:       "*/5 * * * *",
+		SourceType: "local",
+		SourcePath: "/src",
+		TargetType: "local",
+		TargetPath: "/dst",
+	}
+}
+
+// problemKeys returns the keys of the problems Validate finds in cfg.
+func problemKeys(t *testing.T, cfg *Config) []string {
+	t.Helper()
+	err := cfg.Validate()
+	if err == nil {
+		return nil
+	}
+	var ve *ValidationError
+	if !errors.As(err, &ve) {
+		t.Fatalf("Validate returned %T, want *ValidationError", err)
+	}
+	var keys []string
+	for _, p := range ve.Problems {
+		keys = append(keys, p.Key)
+	}
+	return keys
+}
+
+func TestValidateTask(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*Task)
+		want   []string
+	}{
+		{"valid", func(*Task) {}, nil},
+		{"missing name", func(t *Task) { t.Name = "" }, []string{"tasks[0].name"}},
+		{"bad cron", func(t *Task) { t.Cron = "every day" }, []string{"tasks[0].cron"}},
+		{"bad overlap", func(t *Task) { t.Overlap = "never" }, []string{"tasks[0].overlap"}},
+		{"bad source_regex", func(t *Task) { t.SourceRegex = "(" }, []string{"tasks[0].source_regex"}},
+		{"bad include regex", func(t *Task) { t.Include = []string{"*.csv", "re:["} }, []string{"tasks[0].include[1]"}},
+		{"unknown source type", func(t *Task) { t.SourceType = "nfs" }, []string{"tasks[0].source_type"}},
+		{"sftp without auth", func(t *Task) { t.TargetType = "sftp" }, []string{"tasks[0].target_type"}},
+		{"sftp without user", func(t *Task) {
+			t.TargetType = "sftp"
+			t.TargetAuth = &Auth{Host: "h"}
+		}, []string{"tasks[0].target_auth.user"}},
+		{"mirror with delete", func(t *Task) {
+			t.Mode = "mirror"
+			t.SourceAfterTransfer = "delete"
+		}, []string{"tasks[0].source_after_transfer"}},
+		{"mirror with move", func(t *Task) {
+			t.Mode = "mirror"
+			t.SourceAfterTransfer = "move"
+		}, []string{"tasks[0].source_after_transfer"}},
+		{"mirror with keep", func(t *Task) {
+			t.Mode = "mirror"
+			t.SourceAfterTransfer = "keep"
+		}, nil},
+		{"targets and target_type", func(t *Task) {
+			t.Targets = []Target{{Name: "a", TargetType: "local", TargetPath: "/a"}}
+		}, []string{"tasks[0].target_type"}},
+		{"duplicate target", func(t *Task) {
+			t.TargetType, t.TargetPath = "", ""
+			t.Targets = []Target{
+				{Name: "a", TargetType: "local", TargetPath: "/a"},
+				{Name: "a", TargetType: "local", TargetPath: "/b"},
+			}
+		}, []string{"tasks[0].targets[1].name"}},
+		{"bad mode", func(t *Task) { t.Mode = "sync" }, []string{"tasks[0].mode"}},
+		{"bad verify", func(t *Task) { t.Verify = "crc32" }, []string{"tasks[0].verify"}},
+		{"bad on_conflict", func(t *Task) { t.OnConflict = "keep" }, []string{"tasks[0].on_conflict"}},
+		{"bad conflict_suffix", func(t *Task) { t.ConflictSuffix = "date" }, []string{"tasks[0].conflict_suffix"}},
+		{"bad change_detection", func(t *Task) { t.ChangeDetection = "mtime" }, []string{"tasks[0].change_detection"}},
+		{"bad order", func(t *Task) { t.Order = "random" }, []string{"tasks[0].order"}},
+		{"bad source_after_transfer", func(t *Task) { t.SourceAfterTransfer = "archive" }, []string{"tasks[0].source_after_transfer"}},
+		{"marker without fixed part", func(t *Task) { t.SourceMarker = "{name}{stem}" }, []string{"tasks[0].source_marker"}},
+		{"marker with path", func(t *Task) { t.TargetMarker = "ok/{name}" }, []string{"tasks[0].target_marker"}},
+		{"bad glob", func(t *Task) { t.Exclude = []string{"**/tmp", "a/[b"} }, []string{"tasks[0].exclude[1]"}},
+		{"bad retry", func(t *Task) {
+			t.ConnectRetry = RetryPolicy{Jitter: 1.5}
+			t.TransferRetry = RetryPolicy{RetryOn: []string{"network", "disk"}}
+		}, []string{"tasks[0].connect_retry.jitter", "tasks[0].transfer_retry.retry_on[1]"}},
+		{"bad sftp options", func(t *Task) {
+			t.SourceType = "sftp"
+			t.SourceAuth = &Auth{Host: "h", User: "u", HostKeyCheck: "loose", AuthMethods: []string{"password", "otp"}}
+		}, []string{"tasks[0].source_auth.host_key_check", "tasks[0].source_auth.auth_methods[1]"}},
+		{"bad ftps options", func(t *Task) {
+			t.TargetType = "ftps"
+			t.TargetAuth = &Auth{Host: "h", User: "u", TLSMode: "auto", TLSMinVersion: "1.4"}
+		}, []string{"tasks[0].target_auth.tls_mode", "tasks[0].target_auth.tls_min_version"}},
+		{"good webdav options", func(t *Task) {
+			t.TargetType = "webdav"
+			t.TargetAuth = &Auth{Endpoint: "https://dav", AuthType: "Digest", TLSMinVersion: "TLS1.3"}
+		}, nil},
+		{"bad webdav auth_type", func(t *Task) {
+			t.TargetType = "webdav"
+			t.TargetAuth = &Auth{Endpoint: "https://dav", AuthType: "ntlm"}
+		}, []string{"tasks[0].target_auth.auth_type"}},
+		{"bad target on_conflict", func(t *Task) {
+			t.TargetType, t.TargetPath = "", ""
+			t.Targets = []Target{{Name: "a", TargetType: "local", TargetPath: "/a", OnConflict: "keep"}}
+		}, []string{"tasks[0].targets[0].on_conflict"}},
+		{"bad window", func(t *Task) {
+			t.BandwidthWindows = []BandwidthWindow{{From: "8:00", To: "25:00"}}
+		}, []string{"tasks[0].bandwidth_windows[0].to"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			task := validTask()
+			tt.change(&task)
+			got := problemKeys(t, &Config{Tasks: []Task{task}})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("problems at %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateDuplicateTaskNames(t *testing.T) {
+	got := problemKeys(t, &Config{Tasks: []Task{validTask(), validTask()}})
+	if want := []string{"tasks[1].name"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("problems at %q, want %q", got, want)
+	}
+}
+
+func TestTaskValidate(t *testing.T) {
+	task := validTask()
+	if err := task.Validate(); err != nil {
+		t.Fatalf("valid task: %v", err)
+	}
+	task.Mode = "sync"
+	var ve *ValidationError
+	if err := task.Validate(); !errors.As(err, &ve) || len(ve.Problems) != 1 || ve.Problems[0].Key != "mode" {
+		t.Errorf("got %v, want one problem at mode", err)
+	}
+}
+
+const positionsConfig = `max_bandwidth = "10MB"
+
+[[tasks]]
+name = "a"
+cron = "@hourly"
+
+[[tasks]]
+name = "b"
+  cron = "bad"
+source_auth = { host = "h", nope = 1 }
+
+[[tasks.targets]]
+name = "x"
+
+[[tasks.targets]]
+name = "y"
+[tasks.targets.target_auth]
+host = "h"
+`
+
+func TestKeyPositions(t *testing.T) {
+	positions := keyPositions([]byte(positionsConfig))
+	tests := []struct {
+		key          string
+		line, column int
+	}{
+		{"max_bandwidth", 1, 1},
+		{"tasks.0", 3, 3},
+		{"tasks.0.name", 4, 1},
+		{"tasks.1", 7, 3},
+		{"tasks.1.cron", 9, 3},
+		{"tasks.1.source_auth", 10, 1},
+		{"tasks.1.targets.0.name", 13, 1},
+		{"tasks.1.targets.1", 15, 3},
+		{"tasks.1.targets.1.target_auth.host", 18, 1},
+	}
+	for _, tt := range tests {
+		pos, ok := positions[tt.key]
+		if !ok {
+			t.Errorf("%s: not found", tt.key)
+			continue
+		}
+		if pos.Line != tt.line || pos.Column != tt.column {
+			t.Errorf("%s at %d:%d, want %d:%d", tt.key, pos.Line, pos.Column, tt.line, tt.column)
+		}
+	}
+}
+
+func TestLocate(t *testing.T) {
+	positions := keyPositions([]byte(positionsConfig))
+	problems := []Problem{
+		{Key: "tasks.1.cron"},
+		{Key: "tasks.0.source_type"},                // not written: its task
+		{Key: "tasks.1.targets.1.target_auth.user"}, // not written: its table
+		{Key: "bandwidth_windows.0.from"},           // nothing written at all
+	}
+	locate(problems, positions)
+	want := [][2]int{{9, 3}, {3, 3}, {17, 2}, {0, 0}}
+	for i, p := range problems {
+		if got := [2]int{p.Line, p.Column}; got != want[i] {
+			t.Errorf("%s at %v, want %v", p.Key, got, want[i])
+		}
+	}
+}
+
+func TestDisplayKey(t *testing.T) {
+	tests := map[string]string{
+		"tasks.0.cron":                  "tasks[0].cron",
+		"tasks.12.targets.3.name":       "tasks[12].targets[3].name",
+		"bandwidth_windows.1.from":      "bandwidth_windows[1].from",
+		"max_bandwidth":                 "max_bandwidth",
+		"tasks.0.transfer_retry.jitter": "tasks[0].transfer_retry.jitter",
+	}
+	for in, want := range tests {
+		if got := displayKey(in); got != want {
+			t.Errorf("displayKey(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestLoadConfigReportsUnknownKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	data := `bogus = 1
+
+[[tasks]]
+name = "a"
+cron = "@hourly"
+source_type = "local"
+source_path = "/src"
+target_type = "local"
+target_path = "/dst"
+
+[[tasks]]
+name = "b"
+cron = "@hourly"
+nope = 2
+source_type = "local"
+source_path = "/src"
+target_type = "local"
+target_path = "/dst"
+source_auth = { host = "h", port2 = 22 }
+mode = "sync"
+`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := LoadConfig(path)
+	var ve *ValidationError
+	if !errors.As(err, &ve) {
+		t.Fatalf("got %v, want a *ValidationError", err)
+	}
+	var got []string
+	for _, p := range ve.Problems {
+		got = append(got, p.String())
+	}
+	want := []string{
+		"1:1: bogus: unknown key",
+		"14:1: tasks[1].nope: unknown key",
+		`19:29: tasks[1].source_auth.port2: unknown key`,
+		`20:1: tasks[1].mode: unknown value "sync", expected copy or mirror`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("problems:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if !strings.HasPrefix(err.Error(), path+":1:1: ") {
+		t.Errorf("error %q does not start with the file name", err)
+	}
+}
+
+func TestLoadConfigReportsBadValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	data := `max_bandwidth = "10MB"
+
+[[tasks]]
+name = "a"
+cron = "@hourly"
+source_type = "local"
+source_path = "/src"
+target_type = "local"
+target_path = "/dst"
+min_size = "10XB"
+stable_for = "5x"
+
+[[tasks]]
+name = 5
+cron = "@hourly"
+source_type = "sftp"
+source_path = "/src"
+target_type = "local"
+target_path = "/dst"
+source_auth = { host = "h", user = "u", port = "22" }
+bandwidth_windows = [{ from = "08:00", to = "18:00", max_bandwidth = "1QB" }]
+include = [1, 2]
+mode = "sync"
+`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := LoadConfig(path)
+	var ve *ValidationError
+	if !errors.As(err, &ve) {
+		t.Fatalf("got %v, want a *ValidationError", err)
+	}
+	var got []string
+	for _, p := range ve.Problems {
+		got = append(got, fmt.Sprintf("%d:%d: %s", p.Line, p.Column, p.Key))
+	}
+	want := []string{
+		"10:1: tasks[0].min_size",
+		"11:1: tasks[0].stable_for",
+		"14:1: tasks[1].name",
+		"20:41: tasks[1].source_auth.port",
+		"21:54: tasks[1].bandwidth_windows[0].max_bandwidth",
+		"22:1: tasks[1].include",
+		"23:1: tasks[1].mode",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("problems:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if msg := ve.Problems[0].Message; !strings.Contains(msg, `unknown unit "xb"`) {
+		t.Errorf("min_size: %q", msg)
+	}
+}
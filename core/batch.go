@@ -0,0 +1,62 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"filetransferhx/config"
+)
+
+// orderFiles sorts the transfer queue by task.Order. Ties are broken by
+// path so a run picks the same batch every time.
+func orderFiles(files []pendingFile, order string) error {
+	var less func(a, b pendingFile) bool
+	switch order {
+	case "":
+		return nil
+	case "oldest_first":
+		less = func(a, b pendingFile) bool { return a.entry.ModTime.Before(b.entry.ModTime) }
+	case "newest_first":
+		less = func(a, b pendingFile) bool { return a.entry.ModTime.After(b.entry.ModTime) }
+	case "name":
+		less = func(a, b pendingFile) bool { return false }
+	case "smallest_first":
+		less = func(a, b pendingFile) bool { return a.entry.Size < b.entry.Size }
+	default:
+		return fmt.Errorf("unknown order: %s", order)
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		if less(files[i], files[j]) {
+			return true
+		}
+		if less(files[j], files[i]) {
+			return false
+		}
+		return files[i].entry.Path < files[j].entry.Path
+	})
+	return nil
+}
+
+// limitBatch cuts the queue at max_files_per_run and max_bytes_per_run. The
+// first file is always kept, so one larger than the byte cap still goes.
+func limitBatch(files []pendingFile, task config.Task) []pendingFile {
+	n := len(files)
+	if task.MaxFilesPerRun > 0 && n > task.MaxFilesPerRun {
+		n = task.MaxFilesPerRun
+	}
+	if task.MaxBytesPerRun > 0 {
+		var total int64
+		for i := 0; i < n; i++ {
+			total += files[i].entry.Size
+			if i > 0 && total > int64(task.MaxBytesPerRun) {
+				n = i
+				break
+			}
+		}
+	}
+	if n < len(files) {
+		log.Printf("Task %s: transferring %d of %d pending files this run", task.Name, n, len(files))
+	}
+	return files[:n]
+}
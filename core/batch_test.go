@@ -0,0 +1,115 @@
+package core
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"filetransferhx/config"
+	"filetransferhx/protocols"
+)
+
+func pending(path string, size int64, modTime time.Time) pendingFile {
+	return pendingFile{entry: protocols.FileEntry{Path: path, Size: size, ModTime: modTime}}
+}
+
+func paths(files []pendingFile) []string {
+	var ps []string
+	for _, f := range files {
+		ps = append(ps, f.entry.Path)
+	}
+	return ps
+}
+
+func TestOrderFiles(t *testing.T) {
+	t0 := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+	files := []pendingFile{
+		pending("c", 30, t0.Add(time.Hour)),
+		pending("a", 10, t0.Add(2*time.Hour)),
+		pending("b", 10, t0),
+		pending("d", 20, t0),
+	}
+	tests := []struct {
+		order string
+		want  []string
+	}{
+		{"", []string{"c", "a", "b", "d"}},
+		{"oldest_first", []string{"b", "d", "c", "a"}},
+		{"newest_first", []string{"a", "c", "b", "d"}},
+		{"name", []string{"a", "b", "c", "d"}},
+		{"smallest_first", []string{"a", "b", "d", "c"}},
+	}
+	for _, tt := range tests {
+		got := append([]pendingFile(nil), files...)
+		if err := orderFiles(got, tt.order); err != nil {
+			t.Errorf("order %q: %v", tt.order, err)
+			continue
+		}
+		if !reflect.DeepEqual(paths(got), tt.want) {
+			t.Errorf("order %q: got %v, want %v", tt.order, paths(got), tt.want)
+		}
+	}
+	if err := orderFiles(files, "random"); err == nil {
+		t.Error("unknown order: no error")
+	}
+}
+
+func TestLimitBatch(t *testing.T) {
+	files := []pendingFile{
+		pending("a", 100, time.Time{}),
+		pending("b", 50, time.Time{}),
+		pending("c", 50, time.Time{}),
+		pending("d", 10, time.Time{}),
+	}
+	tests := []struct {
+		name     string
+		maxFiles int
+		maxBytes config.ByteSize
+		want     []string
+	}{
+		{"no limits", 0, 0, []string{"a", "b", "c", "d"}},
+		{"files", 2, 0, []string{"a", "b"}},
+		{"more files allowed than pending", 10, 0, []string{"a", "b", "c", "d"}},
+		{"bytes", 0, 160, []string{"a", "b"}},
+		{"bytes exactly", 0, 200, []string{"a", "b", "c"}},
+		{"first file larger than cap", 0, 10, []string{"a"}},
+		{"both, files first", 1, 1000, []string{"a"}},
+		{"both, bytes first", 3, 150, []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		task := config.Task{Name: "t", MaxFilesPerRun: tt.maxFiles, MaxBytesPerRun: tt.maxBytes}
+		if got := paths(limitBatch(files, task)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDirMarkerWaitsForBatch(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	writeFiles(t, src, map[string]string{"d/f1.csv": "1", "d/f2.csv": "2", "d/f3.csv": "3"})
+	task := config.Task{
+		Name:           "t",
+		Cron:           "@hourly",
+		SourceType:     "local",
+		SourcePath:     src,
+		SourceRegex:    `\.csv$`,
+		TargetType:     "local",
+		TargetPath:     dst,
+		TargetMarker:   "_SUCCESS",
+		MaxFilesPerRun: 1,
+		Order:          "name",
+	}
+	tm := newTestManager(t)
+	for run, name := range []string{"d/f1.csv", "d/f2.csv", "d/f3.csv"} {
+		if err := tm.RunTask(context.Background(), task); err != nil {
+			t.Fatal(err)
+		}
+		if !fileExists(dst, name) {
+			t.Fatalf("run %d: %s not transferred", run+1, name)
+		}
+		if last := run == 2; fileExists(dst, "d/_SUCCESS") != last {
+			t.Fatalf("run %d: marker written = %v, want %v", run+1, !last, last)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"filetransferhx/config"
+	"filetransferhx/protocols"
+)
+
+// hashAlgorithm is the digest computed while streaming a file: the verify
+// algorithm when it is a hash, otherwise sha256 if change detection needs
+// one to record.
+func hashAlgorithm(task config.Task) string {
+	switch task.Verify {
+	case "md5", "sha256":
+		return task.Verify
+	}
+	if task.ChangeDetection == "hash" {
+		return "sha256"
+	}
+	return ""
+}
+
+// needsTransfer decides whether entry has to be sent, comparing it against
+// its history record according to task.ChangeDetection:
+//
+//   - "name" (default): only files never transferred before.
+//   - "size_mtime": also files whose size or ModTime changed.
+//   - "hash": like size_mtime, but a file whose ModTime changed while its
+//     size did not is hashed first and only re-sent if the content differs.
+func needsTransfer(ctx context.Context, srcFS protocols.FileSystem, entry protocols.FileEntry, task config.Task, history *TaskHistory) (bool, error) {
+	rec, ok := history.Get(entry.Path)
+	if !ok {
+		return true, nil
+	}
+
+	switch task.ChangeDetection {
+	case "", "name":
+		return false, nil
+	case "size_mtime", "hash":
+	default:
+		return false, fmt.Errorf("unknown change_detection: %s", task.ChangeDetection)
+	}
+
+	// Records written before sizes were tracked: adopt the current state
+	// instead of re-sending everything once after an upgrade.
+	if rec.Size == 0 && rec.ModTime.IsZero() {
+		rec.Size, rec.ModTime = entry.Size, entry.ModTime
+		history.Update(entry.Path, rec)
+		return false, nil
+	}
+
+	if rec.Size != entry.Size {
+		log.Printf("Detected change in %s: size %d -> %d", entry.Path, rec.Size, entry.Size)
+		return true, nil
+	}
+	if rec.ModTime.Equal(entry.ModTime) {
+		return false, nil
+	}
+
+	if task.ChangeDetection == "hash" && rec.Hash != "" {
+		algo, want, _ := strings.Cut(rec.Hash, ":")
+		got, err := hashFile(ctx, srcFS, entry.Path, algo)
+		if err != nil {
+			return false, fmt.Errorf("failed to hash %s: %v", entry.Path, err)
+		}
+		if got == want {
+			// Touched but identical; remember the new ModTime so it is not hashed again
+			rec.ModTime = entry.ModTime
+			history.Update(entry.Path, rec)
+			return false, nil
+		}
+	}
+
+	log.Printf("Detected change in %s: modified %s -> %s", entry.Path, rec.ModTime.Format("2006-01-02 15:04:05"), entry.ModTime.Format("2006-01-02 15:04:05"))
+	return true, nil
+}
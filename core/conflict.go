@@ -0,0 +1,141 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"filetransferhx/config"
+	"filetransferhx/protocols"
+)
+
+// maxRenameAttempts bounds the search for a free name in "rename" mode.
+const maxRenameAttempts = 1000
+
+// Conflict outcomes recorded in history.
+const (
+	conflictOverwritten = "overwritten"
+	conflictRenamed     = "renamed"
+	conflictSkipped     = "skipped"
+)
+
+// resolveConflict applies task.OnConflict when target already exists on
+// dstFS and was not written by an earlier transfer of the same file. It
+// returns the path to write to, or "" if the file is to be skipped, and the
+// outcome to record ("" if there was no conflict).
+//
+// With resume and without atomic_write an interrupted transfer leaves its
+// partial file under the target name; such a file is not a conflict, so
+// transferFile can continue it.
+func resolveConflict(ctx context.Context, srcFS, dstFS protocols.FileSystem, entry protocols.FileEntry, target string, task config.Task, history *TaskHistory) (string, string, error) {
+	// Replacing our own earlier copy of a changed file, renamed or not, is
+	// not a new conflict
+	if rec, ok := history.Get(entry.Path); ok && rec.Conflict != conflictSkipped {
+		if rec.target(entry.Path) == target {
+			return target, "", nil
+		}
+		if rec.Conflict == conflictRenamed && isRenameOf(rec.Target, target) {
+			return rec.Target, conflictRenamed, nil
+		}
+	}
+
+	existing, err := dstFS.Stat(ctx, target)
+	if errors.Is(err, fs.ErrNotExist) {
+		return target, "", nil
+	}
+	if err != nil {
+		// Not knowing whether the target exists is no reason to overwrite it
+		return "", "", fmt.Errorf("failed to check target %s: %w", target, err)
+	}
+	if existing.IsDir {
+		return "", "", fmt.Errorf("target %s is a directory", target)
+	}
+	if task.Resume && !task.AtomicWrite && isPartial(ctx, srcFS, dstFS, entry, target, existing.Size) {
+		return target, "", nil
+	}
+
+	switch task.OnConflict {
+	case "", "overwrite":
+		return target, conflictOverwritten, nil
+	case "skip":
+		return "", conflictSkipped, nil
+	case "fail":
+		return "", "", fmt.Errorf("target %s already exists", target)
+	case "overwrite_if_newer":
+		if entry.ModTime.After(existing.ModTime) {
+			return target, conflictOverwritten, nil
+		}
+		return "", conflictSkipped, nil
+	case "rename":
+		renamed, err := freeName(ctx, dstFS, target, task.ConflictSuffix)
+		if err != nil {
+			return "", "", err
+		}
+		return renamed, conflictRenamed, nil
+	default:
+		return "", "", fmt.Errorf("unknown on_conflict: %s", task.OnConflict)
+	}
+}
+
+// freeName returns a path next to target that does not exist yet:
+// "report_1.csv", "report_2.csv", ... or, with suffix "timestamp",
+// "report_20240131-150405.csv" (numbered as well if that is taken too).
+func freeName(ctx context.Context, dstFS protocols.FileSystem, target, suffix string) (string, error) {
+	dir, name := path.Split(target)
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+
+	switch suffix {
+	case "", "number":
+	case "timestamp":
+		stem += "_" + time.Now().Format("20060102-150405")
+		candidate := dir + stem + ext
+		taken, err := exists(ctx, dstFS, candidate)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return candidate, nil
+		}
+	default:
+		return "", fmt.Errorf("unknown conflict_suffix: %s", suffix)
+	}
+
+	for i := 1; i <= maxRenameAttempts; i++ {
+		candidate := fmt.Sprintf("%s%s_%d%s", dir, stem, i, ext)
+		taken, err := exists(ctx, dstFS, candidate)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("no free name for %s after %d attempts", target, maxRenameAttempts)
+}
+
+// isRenameOf reports whether renamed looks like a name freeName chose for
+// target.
+func isRenameOf(renamed, target string) bool {
+	ext := path.Ext(target)
+	stem := strings.TrimSuffix(target, ext)
+	return strings.HasPrefix(renamed, stem+"_") && strings.HasSuffix(renamed, ext) &&
+		!strings.Contains(strings.TrimPrefix(renamed, stem+"_"), "/")
+}
+
+// exists reports whether relPath exists on dstFS. An error other than "not
+// found" is returned, since it leaves the question open.
+func exists(ctx context.Context, dstFS protocols.FileSystem, relPath string) (bool, error) {
+	_, err := dstFS.Stat(ctx, relPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check target %s: %w", relPath, err)
+	}
+	return true, nil
+}
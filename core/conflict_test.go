@@ -0,0 +1,192 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"filetransferhx/config"
+	"filetransferhx/protocols"
+)
+
+func TestResumeBeforeConflict(t *testing.T) {
+	content := strings.Repeat("0123456789", 50000)
+	for _, policy := range []string{"", "overwrite", "skip", "fail", "overwrite_if_newer", "rename"} {
+		name := policy
+		if name == "" {
+			name = "default"
+		}
+		t.Run(name, func(t *testing.T) {
+			src, dst := t.TempDir(), t.TempDir()
+			writeFiles(t, src, map[string]string{"a.bin": content})
+			// Left by an interrupted run, so newer than the source
+			writeFiles(t, dst, map[string]string{"a.bin": content[:200000]})
+
+			task := config.Task{
+				Name:        "t",
+				Cron:        "@hourly",
+				SourceType:  "local",
+				SourcePath:  src,
+				TargetType:  "local",
+				TargetPath:  dst,
+				Resume:      true,
+				OnConflict:  policy,
+				SourceRegex: `\.bin$`,
+			}
+			tm := newTestManager(t)
+			if err := tm.RunTask(context.Background(), task); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(filepath.Join(dst, "a.bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != content {
+				t.Errorf("target has %d bytes, want %d", len(got), len(content))
+			}
+			rec, ok := tm.HistoryManager.GetTaskHistory("t").Get("a.bin")
+			if !ok || rec.Conflict != "" || rec.Target != "" {
+				t.Errorf("history record %+v, want a plain transfer", rec)
+			}
+		})
+	}
+}
+
+func TestConflictWithForeignFile(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	writeFiles(t, src, map[string]string{"a.txt": "ours, and longer"})
+	writeFiles(t, dst, map[string]string{"a.txt": "theirs"})
+
+	task := config.Task{
+		Name:        "t",
+		Cron:        "@hourly",
+		SourceType:  "local",
+		SourcePath:  src,
+		TargetType:  "local",
+		TargetPath:  dst,
+		Resume:      true,
+		OnConflict:  "skip",
+		SourceRegex: `.*`,
+	}
+	tm := newTestManager(t)
+	if err := tm.RunTask(context.Background(), task); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(filepath.Join(dst, "a.txt"))
+	if string(got) != "theirs" {
+		t.Errorf("target = %q, want it left alone", got)
+	}
+	if rec, _ := tm.HistoryManager.GetTaskHistory("t").Get("a.txt"); rec.Conflict != conflictSkipped {
+		t.Errorf("conflict = %q, want %q", rec.Conflict, conflictSkipped)
+	}
+}
+
+func TestIsRenameOf(t *testing.T) {
+	tests := []struct {
+		renamed, target string
+		want            bool
+	}{
+		{"report_1.csv", "report.csv", true},
+		{"dir/report_20240131-150405.csv", "dir/report.csv", true},
+		{"report_1.csv.gz", "report.csv", false},
+		{"report.csv", "report.csv", false},
+		{"other_1.csv", "report.csv", false},
+		{"report_x/y.csv", "report.csv", false},
+		{"README_1", "README", true},
+	}
+	for _, tt := range tests {
+		if got := isRenameOf(tt.renamed, tt.target); got != tt.want {
+			t.Errorf("isRenameOf(%q, %q) = %v, want %v", tt.renamed, tt.target, got, tt.want)
+		}
+	}
+}
+
+// statFailFS is a target whose first `failures` calls to Stat fail with an
+// error that says nothing about whether the file exists.
+type statFailFS struct {
+	protocols.LocalFileSystem
+	mu       sync.Mutex
+	failures int
+}
+
+func (s *statFailFS) Stat(ctx context.Context, path string) (*protocols.FileEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return nil, errors.New("server busy")
+	}
+	return s.LocalFileSystem.Stat(ctx, path)
+}
+
+func TestConflictCheckFailure(t *testing.T) {
+	tests := []struct {
+		name         string
+		onConflict   string
+		failures     int
+		attempts     int
+		wantConflict string // of the history record, if the file is recorded
+		wantFailure  bool
+	}{
+		{name: "skip, check fails", onConflict: "skip", failures: 1, attempts: 1, wantFailure: true},
+		{name: "rename, check fails", onConflict: "rename", failures: 1, attempts: 1, wantFailure: true},
+		{name: "skip, check fails once", onConflict: "skip", failures: 1, attempts: 2, wantConflict: conflictSkipped},
+		{name: "rename, check fails once", onConflict: "rename", failures: 1, attempts: 2, wantConflict: conflictRenamed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := t.TempDir(), t.TempDir()
+			writeFiles(t, src, map[string]string{"a.txt": "ours"})
+			writeFiles(t, dst, map[string]string{"a.txt": "theirs"})
+
+			task := config.Task{
+				Name:       "t",
+				TargetType: "local",
+				OnConflict: tt.onConflict,
+				TransferRetry: config.RetryPolicy{
+					Attempts: tt.attempts,
+					Backoff:  config.Duration(time.Millisecond),
+					RetryOn:  []string{"all"},
+				},
+			}
+			srcFS := &protocols.LocalFileSystem{RootPath: src}
+			dstFS := &statFailFS{LocalFileSystem: protocols.LocalFileSystem{RootPath: dst}, failures: tt.failures}
+			entry, err := srcFS.Stat(context.Background(), "a.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tm := newTestManager(t)
+			filter, err := newFileFilter(task)
+			if err != nil {
+				t.Fatal(err)
+			}
+			history := tm.HistoryManager.GetTaskHistory("t")
+			dests := []*destination{{task: task, fs: dstFS, history: history, filter: filter}}
+			scan := &scanResult{
+				files: []pendingFile{{entry: *entry, dests: []int{0}}},
+				held:  make(map[markerDir]bool),
+			}
+			tm.transferAll(context.Background(), srcFS, dests, scan, task)
+
+			if got, _ := os.ReadFile(filepath.Join(dst, "a.txt")); string(got) != "theirs" {
+				t.Errorf("target = %q, want it left alone", got)
+			}
+			rec, recorded := history.Get("a.txt")
+			if tt.wantConflict == "" && recorded {
+				t.Errorf("recorded %+v, want no record", rec)
+			}
+			if tt.wantConflict != "" && rec.Conflict != tt.wantConflict {
+				t.Errorf("conflict = %q, want %q", rec.Conflict, tt.wantConflict)
+			}
+			if _, failed := history.GetFailure("a.txt"); failed != tt.wantFailure {
+				t.Errorf("failure recorded = %v, want %v", failed, tt.wantFailure)
+			}
+		})
+	}
+}
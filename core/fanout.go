@@ -0,0 +1,212 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"filetransferhx/config"
+	"filetransferhx/protocols"
+)
+
+// fanoutBufferSize is the chunk size in which a source is handed to several
+// targets at once.
+const fanoutBufferSize = 256 * 1024
+
+// destination is one target of a task. Its task is the task as that target
+// sees it: the target's settings in place of the task's target options and,
+// for [[tasks.targets]], the name "task/target" under which its history is
+// kept.
+type destination struct {
+	task    config.Task
+	label   string // " [target]" for log lines, empty for single-target tasks
+	fs      protocols.FileSystem
+	history *TaskHistory
+	filter  *fileFilter
+	tmpl    *pathTemplate
+}
+
+// targetTasks returns the task as seen by each of its targets.
+func targetTasks(task config.Task) ([]config.Task, error) {
+	if len(task.Targets) == 0 {
+		return []config.Task{task}, nil
+	}
+	if task.TargetType != "" || task.TargetPath != "" {
+		return nil, fmt.Errorf("target_type/target_path cannot be combined with [[tasks.targets]]")
+	}
+
+	names := make(map[string]bool)
+	tasks := make([]config.Task, 0, len(task.Targets))
+	for i, t := range task.Targets {
+		if t.Name == "" {
+			return nil, fmt.Errorf("targets[%d]: name is required", i)
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("duplicate target name: %s", t.Name)
+		}
+		names[t.Name] = true
+
+		dt := task
+		dt.Name = task.Name + "/" + t.Name
+		dt.Targets = nil
+		dt.TargetType = t.TargetType
+		dt.TargetPath = t.TargetPath
+		dt.TargetAuth = t.TargetAuth
+		if t.TargetTemplate != "" {
+			dt.TargetTemplate = t.TargetTemplate
+		}
+		if t.TargetMarker != "" {
+			dt.TargetMarker = t.TargetMarker
+		}
+		if t.OnConflict != "" {
+			dt.OnConflict = t.OnConflict
+		}
+		tasks = append(tasks, dt)
+	}
+	return tasks, nil
+}
+
+// openDestinations connects to every target of task. A target that cannot
+// be reached is left out of this run so the others still get their files;
+// missing reports whether any was.
+func (tm *TransferManager) openDestinations(ctx context.Context, task config.Task) (open []*destination, missing bool, err error) {
+	tasks, err := targetTasks(task)
+	if err != nil {
+		return nil, false, err
+	}
+
+	dests := make([]*destination, 0, len(tasks))
+	for _, dt := range tasks {
+		d := &destination{task: dt}
+		if len(tasks) > 1 {
+			d.label = " [" + strings.TrimPrefix(dt.Name, task.Name+"/") + "]"
+		}
+		if d.filter, err = newFileFilter(dt); err != nil {
+			return nil, false, err
+		}
+		if dt.TargetTemplate != "" {
+			if d.tmpl, err = newPathTemplate(dt.TargetTemplate, task.Name, d.filter.regex); err != nil {
+				return nil, false, err
+			}
+		}
+		dests = append(dests, d)
+	}
+
+	for _, d := range dests {
+		fs, err := tm.connect(ctx, d.task, d.task.TargetType, d.task.TargetPath, d.task.TargetAuth)
+		if err != nil {
+			if len(dests) == 1 {
+				return nil, false, fmt.Errorf("failed to init target fs: %v", err)
+			}
+			log.Printf("Task %s: failed to init target fs, skipping it this run: %v", d.task.Name, err)
+			missing = true
+			continue
+		}
+		d.fs = fs
+		d.history = tm.HistoryManager.GetTaskHistory(d.task.Name)
+		open = append(open, d)
+	}
+	if len(open) == 0 {
+		return nil, false, fmt.Errorf("failed to init any target fs")
+	}
+	return open, missing, nil
+}
+
+// targetPath returns where entry goes on d when transferred at now.
+func (d *destination) targetPath(entry protocols.FileEntry, now time.Time) (string, error) {
+	if d.tmpl == nil {
+		return entry.Path, nil
+	}
+	return d.tmpl.render(entry, now)
+}
+
+// delivery is the transfer of one file to one destination.
+type delivery struct {
+	dest      *destination
+	index     int                  // of dest among the task's destinations
+	fs        protocols.FileSystem // the worker's connection to dest
+	target    string               // path on the target
+	writePath string               // temporary path in atomic mode
+	conflict  string               // on_conflict outcome
+	resolved  bool                 // on_conflict was applied
+	digest    string               // source digest, once delivered
+	w         io.WriteCloser
+	err       error
+}
+
+// fail records err for d and aborts its upload, if one is in progress.
+func (d *delivery) fail(err error) {
+	if d.err != nil {
+		return
+	}
+	d.err = err
+	if d.w != nil {
+		abortWrite(d.w, err)
+		d.w = nil
+	}
+}
+
+// liveDeliveries returns the deliveries that have not failed yet.
+func liveDeliveries(ds []*delivery) []*delivery {
+	var live []*delivery
+	for _, d := range ds {
+		if d.err == nil {
+			live = append(live, d)
+		}
+	}
+	return live
+}
+
+// eachLive calls fn for every delivery that has not failed, one after the
+// other or all at once.
+func eachLive(ds []*delivery, parallel bool, fn func(d *delivery)) {
+	live := liveDeliveries(ds)
+	if !parallel || len(live) < 2 {
+		for _, d := range live {
+			fn(d)
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	for _, d := range live {
+		wg.Add(1)
+		go func(d *delivery) {
+			defer wg.Done()
+			fn(d)
+		}(d)
+	}
+	wg.Wait()
+}
+
+// copyToAll copies src to the writer of every delivery, reading src only
+// once. A writer that fails is aborted and left behind while the others
+// carry on; the copy stops early only when none is left.
+func copyToAll(src io.Reader, ds []*delivery, parallel bool) (int64, error) {
+	buf := make([]byte, fanoutBufferSize)
+	var total int64
+	for {
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			total += int64(n)
+			chunk := buf[:n]
+			eachLive(ds, parallel, func(d *delivery) {
+				if _, err := d.w.Write(chunk); err != nil {
+					d.fail(err)
+				}
+			})
+			if len(liveDeliveries(ds)) == 0 {
+				return total, fmt.Errorf("all targets failed")
+			}
+		}
+		if rerr == io.EOF {
+			return total, nil
+		}
+		if rerr != nil {
+			return total, rerr
+		}
+	}
+}
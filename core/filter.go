@@ -0,0 +1,123 @@
+package core
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+
+	"filetransferhx/config"
+)
+
+// fileFilter decides which files and directories take part in a task.
+type fileFilter struct {
+	regex        *regexp.Regexp // source_regex
+	sourceMarker *regexp.Regexp // names source_marker can produce, nil if unset
+	targetMarker *regexp.Regexp // names target_marker can produce, nil if unset
+	include      []pathPattern
+	exclude      []pathPattern
+	maxDepth     int
+}
+
+// pathPattern is an include/exclude entry matched against the relative
+// path: a doublestar glob such as "**/tmp/**", or a regexp written as
+// "re:<expr>".
+type pathPattern struct {
+	glob  string
+	regex *regexp.Regexp
+}
+
+func (p pathPattern) match(relPath string) bool {
+	if p.regex != nil {
+		return p.regex.MatchString(relPath)
+	}
+	ok, _ := doublestar.Match(p.glob, relPath)
+	return ok
+}
+
+func compilePatterns(key string, list []string) ([]pathPattern, error) {
+	patterns := make([]pathPattern, 0, len(list))
+	for _, s := range list {
+		if expr, ok := strings.CutPrefix(s, "re:"); ok {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s regex %q: %v", key, expr, err)
+			}
+			patterns = append(patterns, pathPattern{regex: re})
+			continue
+		}
+		glob := strings.TrimPrefix(s, "/")
+		if !doublestar.ValidatePattern(glob) {
+			return nil, fmt.Errorf("invalid %s glob %q", key, s)
+		}
+		patterns = append(patterns, pathPattern{glob: glob})
+	}
+	return patterns, nil
+}
+
+func matchAny(patterns []pathPattern, relPath string) bool {
+	for _, p := range patterns {
+		if p.match(relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+func newFileFilter(task config.Task) (*fileFilter, error) {
+	f := &fileFilter{maxDepth: task.MaxDepth}
+	var err error
+	if f.regex, err = regexp.Compile(task.SourceRegex); err != nil {
+		return nil, fmt.Errorf("invalid regex: %v", err)
+	}
+	if task.SourceMarker != "" {
+		if f.sourceMarker, err = compileMarker(task.SourceMarker); err != nil {
+			return nil, fmt.Errorf("invalid source_marker: %v", err)
+		}
+	}
+	if task.TargetMarker != "" {
+		if f.targetMarker, err = compileMarker(task.TargetMarker); err != nil {
+			return nil, fmt.Errorf("invalid target_marker: %v", err)
+		}
+	}
+	if f.include, err = compilePatterns("include", task.Include); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = compilePatterns("exclude", task.Exclude); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// match reports whether the file at relPath is a data file selected by
+// source_regex (on its name) and the include/exclude lists. Marker files
+// never are.
+func (f *fileFilter) match(relPath string) bool {
+	name := path.Base(relPath)
+	if f.sourceMarker != nil && f.sourceMarker.MatchString(name) {
+		return false
+	}
+	if !f.regex.MatchString(name) {
+		return false
+	}
+	if len(f.include) > 0 && !matchAny(f.include, relPath) {
+		return false
+	}
+	return !matchAny(f.exclude, relPath)
+}
+
+// descend reports whether the directory at relPath is to be listed: it is
+// not excluded and not deeper than max_depth.
+func (f *fileFilter) descend(relPath string) bool {
+	if f.maxDepth > 0 && strings.Count(relPath, "/")+1 >= f.maxDepth {
+		return false
+	}
+	return !matchAny(f.exclude, relPath)
+}
+
+// isTargetMarker reports whether name is a marker written by this task.
+func (f *fileFilter) isTargetMarker(name string) bool {
+	return f.targetMarker != nil && f.targetMarker.MatchString(name)
+}
@@ -8,9 +8,53 @@ import (
 )
 
 type TaskHistory struct {
-	// Map relative path -> Transfer Time
-	Records map[string]time.Time `json:"records"`
-	mu      sync.RWMutex
+	// Map relative path -> last transfer
+	Records map[string]Record `json:"records"`
+	// Map relative path -> files whose last runs failed
+	Failures map[string]Failure `json:"failures,omitempty"`
+	mu       sync.RWMutex
+}
+
+// Failure counts the consecutive runs in which a file could not be
+// transferred.
+type Failure struct {
+	Count       int       `json:"count"`
+	LastError   string    `json:"last_error"`
+	LastAttempt time.Time `json:"last_attempt"`
+	Size        int64     `json:"size"`     // source size at the last attempt
+	ModTime     time.Time `json:"mod_time"` // source ModTime at the last attempt
+	Quarantined bool      `json:"quarantined,omitempty"`
+}
+
+// Record describes the last transfer of a file.
+type Record struct {
+	TransferTime time.Time `json:"transfer_time"`
+	Size         int64     `json:"size"`
+	ModTime      time.Time `json:"mod_time"`
+	Hash         string    `json:"hash,omitempty"`     // "sha256:<hex>" or "md5:<hex>"
+	Version      int       `json:"version,omitempty"`  // number of times the file was transferred
+	Target       string    `json:"target,omitempty"`   // target path, if not the same as the source path
+	Conflict     string    `json:"conflict,omitempty"` // on_conflict outcome: overwritten, renamed or skipped
+}
+
+// target returns where the file recorded under path was written, or for a
+// skipped file, the existing target that was left alone.
+func (r Record) target(path string) string {
+	if r.Target != "" {
+		return r.Target
+	}
+	return path
+}
+
+// UnmarshalJSON also accepts the old format, where a record was only the
+// transfer time.
+func (r *Record) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*r = Record{}
+		return json.Unmarshal(data, &r.TransferTime)
+	}
+	type plain Record
+	return json.Unmarshal(data, (*plain)(r))
 }
 
 type HistoryManager struct {
@@ -42,9 +86,12 @@ func (hm *HistoryManager) Load() error {
 	return json.Unmarshal(data, &hm.Tasks)
 }
 
+// Save writes the history to hm.Path. It may run while transfers still
+// record to it, e.g. on a second interrupt during shutdown.
 func (hm *HistoryManager) Save() error {
-	hm.mu.RLock()
-	defer hm.mu.RUnlock()
+	// Exclusive, so two saves cannot interleave their writes to the file
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
 
 	data, err := json.MarshalIndent(hm.Tasks, "", "  ")
 	if err != nil {
@@ -60,16 +107,48 @@ func (hm *HistoryManager) GetTaskHistory(taskName string) *TaskHistory {
 
 	if _, ok := hm.Tasks[taskName]; !ok {
 		hm.Tasks[taskName] = &TaskHistory{
-			Records: make(map[string]time.Time),
+			Records: make(map[string]Record),
 		}
 	}
 	return hm.Tasks[taskName]
 }
 
-func (th *TaskHistory) Add(path string) {
+// MarshalJSON holds th's lock, so the maps are not written to while they are
+// encoded.
+func (th *TaskHistory) MarshalJSON() ([]byte, error) {
+	th.mu.RLock()
+	defer th.mu.RUnlock()
+	type plain struct {
+		Records  map[string]Record  `json:"records"`
+		Failures map[string]Failure `json:"failures,omitempty"`
+	}
+	return json.Marshal(plain{Records: th.Records, Failures: th.Failures})
+}
+
+// Add records a transfer of path, counting it as a new version if the path
+// was transferred before.
+func (th *TaskHistory) Add(path string, rec Record) {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	if rec.TransferTime.IsZero() {
+		rec.TransferTime = time.Now()
+	}
+	rec.Version = th.Records[path].Version + 1
+	th.Records[path] = rec
+}
+
+func (th *TaskHistory) Get(path string) (Record, bool) {
+	th.mu.RLock()
+	defer th.mu.RUnlock()
+	rec, ok := th.Records[path]
+	return rec, ok
+}
+
+// Update replaces the record of path without counting a new version.
+func (th *TaskHistory) Update(path string, rec Record) {
 	th.mu.Lock()
 	defer th.mu.Unlock()
-	th.Records[path] = time.Now()
+	th.Records[path] = rec
 }
 
 func (th *TaskHistory) Has(path string) bool {
@@ -82,8 +161,8 @@ func (th *TaskHistory) Has(path string) bool {
 func (th *TaskHistory) GetTransferTime(path string) (time.Time, bool) {
 	th.mu.RLock()
 	defer th.mu.RUnlock()
-	t, ok := th.Records[path]
-	return t, ok
+	rec, ok := th.Records[path]
+	return rec.TransferTime, ok
 }
 
 func (th *TaskHistory) Remove(path string) {
@@ -91,3 +170,38 @@ func (th *TaskHistory) Remove(path string) {
 	defer th.mu.Unlock()
 	delete(th.Records, path)
 }
+
+// AddFailure counts another failed run for path and quarantines it once
+// quarantineAfter (if > 0) consecutive runs failed. A file that changed
+// since its last failure starts counting again.
+func (th *TaskHistory) AddFailure(path string, size int64, modTime time.Time, err error, quarantineAfter int) Failure {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	if th.Failures == nil {
+		th.Failures = make(map[string]Failure)
+	}
+	f := th.Failures[path]
+	if f.Size != size || !f.ModTime.Equal(modTime) {
+		f = Failure{}
+	}
+	f.Count++
+	f.LastError = err.Error()
+	f.LastAttempt = time.Now()
+	f.Size, f.ModTime = size, modTime
+	f.Quarantined = quarantineAfter > 0 && f.Count >= quarantineAfter
+	th.Failures[path] = f
+	return f
+}
+
+func (th *TaskHistory) GetFailure(path string) (Failure, bool) {
+	th.mu.RLock()
+	defer th.mu.RUnlock()
+	f, ok := th.Failures[path]
+	return f, ok
+}
+
+func (th *TaskHistory) ClearFailure(path string) {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	delete(th.Failures, path)
+}
@@ -0,0 +1,47 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHistorySaveWhileRecording(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+	hm := NewHistoryManager(path)
+	th := hm.GetTaskHistory("t")
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 500; i++ {
+			th.Add(fmt.Sprintf("f%d.csv", i), Record{Size: int64(i)})
+			th.AddFailure(fmt.Sprintf("g%d.csv", i), 1, time.Time{}, errors.New("refused"), 0)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if err := hm.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	if err := hm.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewHistoryManager(path)
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	got := loaded.GetTaskHistory("t")
+	if rec, ok := got.Get("f499.csv"); !ok || rec.Size != 499 || rec.Version != 1 {
+		t.Errorf("f499.csv: %+v, %v", rec, ok)
+	}
+	if f, ok := got.GetFailure("g499.csv"); !ok || f.Count != 1 || f.LastError != "refused" {
+		t.Errorf("g499.csv failure: %+v, %v", f, ok)
+	}
+}
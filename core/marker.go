@@ -0,0 +1,81 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"filetransferhx/protocols"
+)
+
+// Marker patterns name a companion file for each data file, e.g. "{name}.ok"
+// for data.csv.ok or "{stem}.done" for data.done. A pattern without
+// placeholders, such as "_SUCCESS", is a marker for the whole directory.
+var markerPlaceholders = strings.NewReplacer("{name}", "", "{stem}", "")
+
+// markerName returns the marker that belongs to the data file fileName.
+func markerName(pattern, fileName string) string {
+	stem := strings.TrimSuffix(fileName, path.Ext(fileName))
+	return strings.NewReplacer("{name}", fileName, "{stem}", stem).Replace(pattern)
+}
+
+// isDirMarker reports whether pattern names one marker per directory.
+func isDirMarker(pattern string) bool {
+	return markerPlaceholders.Replace(pattern) == pattern
+}
+
+// compileMarker returns a regexp matching every name pattern can produce, so
+// marker files can be told apart from data files.
+func compileMarker(pattern string) (*regexp.Regexp, error) {
+	if strings.Contains(pattern, "/") {
+		return nil, fmt.Errorf("marker %q must be a file name, not a path", pattern)
+	}
+	if markerPlaceholders.Replace(pattern) == "" {
+		return nil, fmt.Errorf("marker %q needs a fixed part besides {name}/{stem}", pattern)
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	rest := pattern
+	for {
+		i := strings.IndexByte(rest, '{')
+		if i < 0 {
+			break
+		}
+		if p := rest[i:]; strings.HasPrefix(p, "{name}") || strings.HasPrefix(p, "{stem}") {
+			b.WriteString(regexp.QuoteMeta(rest[:i]))
+			b.WriteString(".+")
+			rest = rest[i+len("{name}"):]
+			continue
+		}
+		b.WriteString(regexp.QuoteMeta(rest[:i+1]))
+		rest = rest[i+1:]
+	}
+	b.WriteString(regexp.QuoteMeta(rest))
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// hasSourceMarker reports whether the marker for the data file name is among
+// the names listed in its directory.
+func hasSourceMarker(pattern, name string, names map[string]bool) bool {
+	if isDirMarker(pattern) {
+		return names[pattern]
+	}
+	return names[markerName(pattern, name)]
+}
+
+// targetMarkerPath returns where the per-file target marker for relPath goes.
+func targetMarkerPath(pattern, relPath string) string {
+	return path.Join(path.Dir(relPath), markerName(pattern, path.Base(relPath)))
+}
+
+// writeMarker creates an empty marker file.
+func writeMarker(ctx context.Context, fs protocols.FileSystem, relPath string) error {
+	w, err := fs.Create(ctx, relPath)
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
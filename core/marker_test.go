@@ -0,0 +1,131 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"filetransferhx/config"
+)
+
+func TestCompileMarker(t *testing.T) {
+	tests := []struct {
+		pattern string
+		match   []string
+		noMatch []string
+		wantErr bool
+	}{
+		{pattern: "{name}.ok", match: []string{"a.csv.ok", "x.ok"}, noMatch: []string{".ok", "a.csv", "a.ok.bak"}},
+		{pattern: "{stem}.done", match: []string{"a.done"}, noMatch: []string{"a.csv"}},
+		{pattern: "_SUCCESS", match: []string{"_SUCCESS"}, noMatch: []string{"x_SUCCESS", "_SUCCESS.csv"}},
+		{pattern: "a{b}.ok", match: []string{"a{b}.ok"}, noMatch: []string{"ab.ok"}},
+		{pattern: "{name}", wantErr: true},
+		{pattern: "done/{name}", wantErr: true},
+	}
+	for _, tt := range tests {
+		re, err := compileMarker(tt.pattern)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("compileMarker(%q): no error", tt.pattern)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("compileMarker(%q): %v", tt.pattern, err)
+			continue
+		}
+		for _, name := range tt.match {
+			if !re.MatchString(name) {
+				t.Errorf("%q does not match %q", tt.pattern, name)
+			}
+		}
+		for _, name := range tt.noMatch {
+			if re.MatchString(name) {
+				t.Errorf("%q matches %q", tt.pattern, name)
+			}
+		}
+	}
+}
+
+func TestMarkerName(t *testing.T) {
+	tests := []struct{ pattern, file, want string }{
+		{"{name}.ok", "a.csv", "a.csv.ok"},
+		{"{stem}.done", "a.csv", "a.done"},
+		{"_SUCCESS", "a.csv", "_SUCCESS"},
+	}
+	for _, tt := range tests {
+		if got := markerName(tt.pattern, tt.file); got != tt.want {
+			t.Errorf("markerName(%q, %q) = %q, want %q", tt.pattern, tt.file, got, tt.want)
+		}
+	}
+}
+
+func TestDirMarkerWaitsForHeldFiles(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour)
+	tests := []struct {
+		name    string
+		task    func(*config.Task)
+		prepare func(t *testing.T, src string)
+		release func(t *testing.T, src string)
+	}{
+		{
+			name: "source marker missing",
+			task: func(task *config.Task) { task.SourceMarker = "{name}.ok" },
+			prepare: func(t *testing.T, src string) {
+				writeFiles(t, src, map[string]string{"d/f1.csv.ok": ""})
+			},
+			release: func(t *testing.T, src string) {
+				writeFiles(t, src, map[string]string{"d/f2.csv.ok": ""})
+			},
+		},
+		{
+			name: "not stable",
+			task: func(task *config.Task) { task.MinAge = config.Duration(time.Hour) },
+			prepare: func(t *testing.T, src string) {
+				os.Chtimes(filepath.Join(src, "d", "f1.csv"), old, old)
+			},
+			release: func(t *testing.T, src string) {
+				os.Chtimes(filepath.Join(src, "d", "f2.csv"), old, old)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := t.TempDir(), t.TempDir()
+			writeFiles(t, src, map[string]string{"d/f1.csv": "1", "d/f2.csv": "2"})
+			tt.prepare(t, src)
+
+			task := config.Task{
+				Name:         "t",
+				Cron:         "@hourly",
+				SourceType:   "local",
+				SourcePath:   src,
+				SourceRegex:  `\.csv$`,
+				TargetType:   "local",
+				TargetPath:   dst,
+				TargetMarker: "_SUCCESS",
+			}
+			tt.task(&task)
+			tm := newTestManager(t)
+			if err := tm.RunTask(context.Background(), task); err != nil {
+				t.Fatal(err)
+			}
+			if !fileExists(dst, "d/f1.csv") || fileExists(dst, "d/f2.csv") {
+				t.Fatal("expected only f1.csv to be transferred")
+			}
+			if fileExists(dst, "d/_SUCCESS") {
+				t.Fatal("marker written while f2.csv is held back")
+			}
+
+			tt.release(t, src)
+			if err := tm.RunTask(context.Background(), task); err != nil {
+				t.Fatal(err)
+			}
+			if !fileExists(dst, "d/f2.csv") || !fileExists(dst, "d/_SUCCESS") {
+				t.Fatal("expected f2.csv and the marker once f2.csv is released")
+			}
+		})
+	}
+}
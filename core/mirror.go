@@ -0,0 +1,185 @@
+package core
+
+import (
+	"context"
+	"log"
+	"path"
+	"sort"
+	"strings"
+
+	"filetransferhx/config"
+	"filetransferhx/protocols"
+)
+
+// defaultMirrorMaxDeletions applies when mirror_max_deletions is not set.
+const defaultMirrorMaxDeletions = 100
+
+// mirror removes target files that match source_regex but no longer exist
+// on the source, then the directories left empty. Nothing is deleted when
+// the source scan was incomplete, when the source matched nothing at all, or
+// when more files would go than mirror_max_deletions allows.
+func (tm *TransferManager) mirror(ctx context.Context, dstFS protocols.FileSystem, task config.Task, history *TaskHistory, filter *fileFilter, scan *scanResult) {
+	if scan.incomplete {
+		log.Printf("Task %s: source listing incomplete, skipping mirror deletions", task.Name)
+		return
+	}
+
+	var orphans []orphan
+	var dirs []string
+	if task.TargetTemplate != "" {
+		// Target paths cannot be mapped back to source paths, so only files
+		// this task recorded are considered.
+		orphans, dirs = recordedOrphans(ctx, dstFS, history, filter, scan)
+	} else if err := tm.findOrphans(ctx, dstFS, "", task, filter, expectedTargets(history, scan), &orphans, &dirs); err != nil {
+		log.Printf("Task %s: failed to list target for mirror: %v", task.Name, err)
+		return
+	}
+	if len(orphans) == 0 {
+		return
+	}
+
+	if len(scan.seen) == 0 {
+		log.Printf("Task %s: source is empty but target has %d files, refusing to mirror deletions", task.Name, len(orphans))
+		return
+	}
+	limit := task.MirrorMaxDeletions
+	if limit == 0 {
+		limit = defaultMirrorMaxDeletions
+	}
+	if limit > 0 && len(orphans) > limit {
+		log.Printf("Task %s: mirror would delete %d files (limit %d), aborting deletions", task.Name, len(orphans), limit)
+		return
+	}
+
+	for _, o := range orphans {
+		if err := dstFS.Remove(ctx, o.target); err != nil {
+			log.Printf("Failed to remove orphan %s: %v", o.target, err)
+			continue
+		}
+		log.Printf("Removed orphan: %s", o.target)
+		if task.TargetMarker != "" && !isDirMarker(task.TargetMarker) {
+			dstFS.Remove(ctx, targetMarkerPath(task.TargetMarker, o.target))
+		}
+		// Send the file again should it reappear on the source
+		history.Remove(o.source)
+	}
+
+	// Deepest first, so parents are empty by the time they are reached
+	for i := len(dirs) - 1; i >= 0; i-- {
+		entries, err := dstFS.List(ctx, dirs[i])
+		if err != nil || len(entries) > 0 {
+			continue
+		}
+		if err := dstFS.Remove(ctx, dirs[i]); err == nil {
+			log.Printf("Removed empty directory: %s", dirs[i])
+		}
+	}
+}
+
+// orphan is a target file whose source is gone, with the history key of
+// that source.
+type orphan struct {
+	target string
+	source string
+}
+
+// findOrphans walks the target and collects files without a source
+// counterpart, plus every directory in walk order.
+func (tm *TransferManager) findOrphans(ctx context.Context, dstFS protocols.FileSystem, relPath string, task config.Task, filter *fileFilter, expected map[string]bool, orphans *[]orphan, dirs *[]string) error {
+	entries, err := dstFS.List(ctx, relPath)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		entryRelPath := path.Join(relPath, entry.Name)
+		if entry.IsDir {
+			// Leave alone what the source scan never looked at
+			if !filter.descend(entryRelPath) {
+				continue
+			}
+			*dirs = append(*dirs, entryRelPath)
+			if err := tm.findOrphans(ctx, dstFS, entryRelPath, task, filter, expected, orphans, dirs); err != nil {
+				return err
+			}
+			continue
+		}
+		if !filter.match(entryRelPath) || expected[entryRelPath] || filter.isTargetMarker(entry.Name) {
+			continue
+		}
+		// Keep partial uploads so resume can pick them up
+		if task.AtomicWrite && isTempName(entry.Name, task) {
+			continue
+		}
+		*orphans = append(*orphans, orphan{target: entryRelPath, source: entryRelPath})
+	}
+	return nil
+}
+
+// expectedTargets returns the target paths of the files still on the
+// source: their own paths, plus where on_conflict renamed them to.
+func expectedTargets(history *TaskHistory, scan *scanResult) map[string]bool {
+	expected := make(map[string]bool, len(scan.seen))
+	for p := range scan.seen {
+		expected[p] = true
+	}
+	history.mu.RLock()
+	defer history.mu.RUnlock()
+	for source, rec := range history.Records {
+		if scan.seen[source] && rec.Target != "" && rec.Conflict != conflictSkipped {
+			expected[rec.Target] = true
+		}
+	}
+	return expected
+}
+
+// recordedOrphans collects the targets of history records whose source is
+// gone, plus their parent directories ordered so the deepest come last.
+// Records of targets that no longer exist are dropped.
+func recordedOrphans(ctx context.Context, dstFS protocols.FileSystem, history *TaskHistory, filter *fileFilter, scan *scanResult) ([]orphan, []string) {
+	history.mu.RLock()
+	var candidates []orphan
+	for source, rec := range history.Records {
+		if scan.seen[source] || !filter.match(source) {
+			continue
+		}
+		if rec.Conflict == conflictSkipped {
+			// The target belongs to someone else; just forget the source
+			candidates = append(candidates, orphan{source: source})
+			continue
+		}
+		candidates = append(candidates, orphan{target: rec.target(source), source: source})
+	}
+	history.mu.RUnlock()
+
+	var orphans []orphan
+	parents := make(map[string]bool)
+	for _, o := range candidates {
+		if o.target == "" {
+			history.Remove(o.source)
+			continue
+		}
+		if _, err := dstFS.Stat(ctx, o.target); err != nil {
+			history.Remove(o.source)
+			continue
+		}
+		orphans = append(orphans, o)
+		for dir := path.Dir(o.target); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			parents[dir] = true
+		}
+	}
+
+	dirs := make([]string, 0, len(parents))
+	for dir := range parents {
+		dirs = append(dirs, dir)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		return strings.Count(dirs[i], "/") < strings.Count(dirs[j], "/")
+	})
+	return orphans, dirs
+}
+
+func isTempName(name string, task config.Task) bool {
+	prefix, suffix := tempAffixes(task)
+	return strings.HasPrefix(name, prefix) && strings.HasSuffix(name, suffix)
+}
@@ -0,0 +1,70 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/robfig/cron/v3"
+
+	"filetransferhx/config"
+)
+
+// overlapWrapper returns the cron.JobWrapper implementing task.Overlap:
+//
+//   - "skip" (default): a run that starts while the previous one is still
+//     going is dropped.
+//   - "queue": it waits for the previous run instead. At most one run is
+//     kept waiting; further ones are dropped.
+//   - "allow": runs may overlap.
+func overlapWrapper(task config.Task) (cron.JobWrapper, error) {
+	switch task.Overlap {
+	case "", "skip":
+		return skipIfRunning(task.Name), nil
+	case "queue":
+		return queueIfRunning(task.Name), nil
+	case "allow":
+		return func(j cron.Job) cron.Job { return j }, nil
+	default:
+		return nil, fmt.Errorf("unknown overlap: %s", task.Overlap)
+	}
+}
+
+// skipIfRunning is cron.SkipIfStillRunning with a log line naming the task.
+func skipIfRunning(name string) cron.JobWrapper {
+	return func(j cron.Job) cron.Job {
+		var mu sync.Mutex
+		return cron.FuncJob(func() {
+			if !mu.TryLock() {
+				log.Printf("Task %s is still running, skipping this run", name)
+				return
+			}
+			defer mu.Unlock()
+			j.Run()
+		})
+	}
+}
+
+// queueIfRunning is cron.DelayIfStillRunning, except that runs do not pile
+// up behind a slow one: only a single run waits.
+func queueIfRunning(name string) cron.JobWrapper {
+	return func(j cron.Job) cron.Job {
+		var running sync.Mutex
+		waiting := make(chan struct{}, 1)
+		return cron.FuncJob(func() {
+			if !running.TryLock() {
+				select {
+				case waiting <- struct{}{}:
+					log.Printf("Task %s is still running, queueing this run", name)
+				default:
+					log.Printf("Task %s is still running and a run is already queued, skipping this run", name)
+					return
+				}
+				running.Lock()
+				<-waiting
+			}
+			defer running.Unlock()
+			j.Run()
+		})
+	}
+}
@@ -0,0 +1,476 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"filetransferhx/config"
+	"filetransferhx/protocols"
+)
+
+// markerDir is a target directory of one destination.
+type markerDir struct {
+	dest int
+	dir  string
+}
+
+// workerConns are the connections a worker transfers through. The first
+// worker borrows the task's connections; every other worker opens its own
+// set, since a connection such as FTPFileSystem's ServerConn serves one
+// transfer at a time. A worker that has to reconnect owns the replacements.
+type workerConns struct {
+	src     protocols.FileSystem
+	dsts    []protocols.FileSystem
+	ownSrc  bool
+	ownDsts []bool
+
+	mu      sync.Mutex // guards the fields above against abort
+	aborted bool
+}
+
+func borrowConns(srcFS protocols.FileSystem, dests []*destination) *workerConns {
+	c := &workerConns{src: srcFS, dsts: make([]protocols.FileSystem, len(dests)), ownDsts: make([]bool, len(dests))}
+	for i, d := range dests {
+		c.dsts[i] = d.fs
+	}
+	return c
+}
+
+// close closes the connections the worker opened itself.
+func (c *workerConns) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.aborted {
+		return
+	}
+	if c.ownSrc {
+		c.src.Close()
+	}
+	for i, fs := range c.dsts {
+		if c.ownDsts[i] && fs != nil {
+			fs.Close()
+		}
+	}
+}
+
+// abort closes every connection of the worker, borrowed or not, so that
+// reads and writes blocked on a stalled server return. Connections opened
+// by a later reconnect are closed straight away.
+func (c *workerConns) abort() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.aborted = true
+	c.src.Close()
+	for _, fs := range c.dsts {
+		if fs != nil {
+			fs.Close()
+		}
+	}
+}
+
+// reconnect replaces the source connection and those of the destinations
+// listed in which.
+func (tm *TransferManager) reconnect(ctx context.Context, c *workerConns, task config.Task, dests []*destination, which []int) error {
+	src, err := tm.connect(ctx, task, task.SourceType, task.SourcePath, task.SourceAuth)
+	if err != nil {
+		return fmt.Errorf("failed to init source fs: %v", err)
+	}
+	if err := c.replace(-1, src); err != nil {
+		return err
+	}
+
+	for _, i := range which {
+		d := dests[i]
+		fs, err := tm.connect(ctx, d.task, d.task.TargetType, d.task.TargetPath, d.task.TargetAuth)
+		if err != nil {
+			return fmt.Errorf("failed to init target fs%s: %v", d.label, err)
+		}
+		if err := c.replace(i, fs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replace puts fs in place of the source connection (i < 0) or that of
+// destination i.
+func (c *workerConns) replace(i int, fs protocols.FileSystem) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.aborted {
+		fs.Close()
+		return fmt.Errorf("connections closed on shutdown")
+	}
+	if i < 0 {
+		if c.ownSrc {
+			c.src.Close()
+		}
+		c.src, c.ownSrc = fs, true
+		return nil
+	}
+	if c.ownDsts[i] {
+		c.dsts[i].Close()
+	}
+	c.dsts[i], c.ownDsts[i] = fs, true
+	return nil
+}
+
+// transferAll transfers files with up to task.Concurrency workers, each with
+// its own workerConns. Once ctx is cancelled no further file is started, and
+// the files in progress are aborted after the shutdown grace period.
+func (tm *TransferManager) transferAll(ctx context.Context, srcFS protocols.FileSystem, dests []*destination, scan *scanResult, task config.Task) {
+	files := scan.files
+	workers := task.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(files) {
+		workers = len(files)
+	}
+
+	// Directory markers are written once every file of the directory made it,
+	// and none was left for a later run
+	var mu sync.Mutex
+	complete := make(map[markerDir]bool)
+
+	xfer, cancel := withGrace(ctx, tm.shutdownGrace())
+	defer cancel()
+
+	// Not every file system watches ctx while reading or writing, so once
+	// the grace period is over the connections are closed under the
+	// transfers still going
+	var connsMu sync.Mutex
+	var allConns []*workerConns
+	stop := context.AfterFunc(xfer, func() {
+		connsMu.Lock()
+		defer connsMu.Unlock()
+		log.Printf("Task %s: shutdown grace period over, closing connections", task.Name)
+		for _, c := range allConns {
+			c.abort()
+		}
+	})
+	defer stop()
+
+	jobs := make(chan pendingFile)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+
+			conns := borrowConns(srcFS, dests)
+			defer conns.close()
+			connsMu.Lock()
+			allConns = append(allConns, conns)
+			if xfer.Err() != nil {
+				conns.abort()
+			}
+			connsMu.Unlock()
+			if id > 0 {
+				// A worker that cannot connect leaves its share to the others
+				all := make([]int, len(dests))
+				for j := range all {
+					all[j] = j
+				}
+				if err := tm.reconnect(ctx, conns, task, dests, all); err != nil {
+					log.Printf("Task %s worker %d: %v", task.Name, id, err)
+					return
+				}
+			}
+
+			for file := range jobs {
+				for _, d := range tm.transferOne(xfer, conns, file, task, dests) {
+					if d.target == "" || d.dest.task.TargetMarker == "" || !isDirMarker(d.dest.task.TargetMarker) {
+						continue
+					}
+					key := markerDir{dest: d.index, dir: path.Dir(d.target)}
+					mu.Lock()
+					prev, seen := complete[key]
+					complete[key] = d.err == nil && (prev || !seen)
+					mu.Unlock()
+				}
+			}
+		}(i)
+	}
+
+feed:
+	for i, file := range files {
+		select {
+		case jobs <- file:
+		case <-ctx.Done():
+			log.Printf("Task %s: shutting down, leaving %d files for the next run", task.Name, len(files)-i)
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	// Directories with files left over are not complete
+	if ctx.Err() != nil {
+		return
+	}
+
+	for key, ok := range complete {
+		d := dests[key.dest]
+		if !ok {
+			log.Printf("Not writing marker in %s%s: some transfers failed", key.dir, d.label)
+			continue
+		}
+		if scan.held[key] {
+			log.Printf("Not writing marker in %s%s: some files are left for a later run", key.dir, d.label)
+			continue
+		}
+		marker := path.Join(key.dir, d.task.TargetMarker)
+		if err := writeMarker(ctx, d.fs, marker); err != nil {
+			log.Printf("Failed to write marker %s%s: %v", marker, d.label, err)
+		}
+	}
+}
+
+// resolveTarget applies on_conflict to d, whose target is the mapped path,
+// and reports whether the file is to be written. A file skipped by
+// on_conflict is recorded as such; a failed check fails d.
+func resolveTarget(ctx context.Context, srcFS protocols.FileSystem, entry protocols.FileEntry, d *delivery) bool {
+	dest, mapped := d.dest, d.target
+	target, conflict, err := resolveConflict(ctx, srcFS, d.fs, entry, mapped, dest.task, dest.history)
+	if err != nil {
+		d.fail(err)
+		return false
+	}
+	d.target, d.conflict, d.resolved = target, conflict, true
+	switch conflict {
+	case conflictSkipped:
+		log.Printf("Skipped %s: target %s already exists (on_conflict: %s)%s", entry.Path, mapped, dest.task.OnConflict, dest.label)
+		rec := Record{
+			Size:     entry.Size,
+			ModTime:  entry.ModTime,
+			Conflict: conflictSkipped,
+		}
+		if mapped != entry.Path {
+			rec.Target = mapped
+		}
+		dest.history.Add(entry.Path, rec)
+		return false
+	case conflictOverwritten:
+		log.Printf("Target %s already exists, overwriting%s", target, dest.label)
+	case conflictRenamed:
+		log.Printf("Target %s already exists, writing to %s%s", mapped, target, dest.label)
+	}
+	return true
+}
+
+// transferOne transfers a single file to the destinations that need it and
+// records each outcome in that destination's history. The source is read
+// once for all of them, a failing destination does not stop the others,
+// and failed deliveries are retried according to task.TransferRetry.
+// It returns the deliveries; a file skipped by on_conflict has no target.
+func (tm *TransferManager) transferOne(ctx context.Context, c *workerConns, file pendingFile, task config.Task, dests []*destination) []*delivery {
+	entry := file.entry
+	now := time.Now()
+
+	var ds, pending []*delivery
+	for _, i := range file.dests {
+		dest := dests[i]
+		d := &delivery{dest: dest, index: i, fs: c.dsts[i]}
+		ds = append(ds, d)
+
+		mapped, err := dest.targetPath(entry, now)
+		if err != nil {
+			d.fail(err)
+			continue
+		}
+
+		d.target = mapped
+		pending = append(pending, d)
+	}
+
+	policy := retryPolicy{task.TransferRetry}
+	for attempt := 1; len(pending) > 0; attempt++ {
+		// A target that could not be checked is checked again on retry
+		var write []*delivery
+		for _, d := range pending {
+			if d.resolved || resolveTarget(ctx, c.src, entry, d) {
+				write = append(write, d)
+			}
+		}
+		if len(write) > 0 {
+			digest, err := tm.transferFile(ctx, c.src, entry, write, task)
+			for _, d := range write {
+				if err != nil {
+					d.fail(err)
+				} else if d.err == nil {
+					d.digest = digest
+				}
+			}
+		}
+
+		var retry []*delivery
+		var broken []int
+		for _, d := range pending {
+			if d.err == nil || attempt >= policy.attempts() || !policy.retryable(d.err) {
+				continue
+			}
+			retry = append(retry, d)
+			if class := errorClass(d.err); class == errClassNetwork || class == errClassTimeout {
+				broken = append(broken, d.index)
+			}
+		}
+		if len(retry) == 0 {
+			break
+		}
+
+		wait := policy.delay(attempt + 1)
+		for _, d := range retry {
+			log.Printf("Transfer of %s%s failed (attempt %d/%d), retrying in %s: %v", entry.Path, d.dest.label, attempt, policy.attempts(), wait.Round(time.Millisecond), d.err)
+		}
+		if sleep(ctx, wait) != nil {
+			break
+		}
+		if len(broken) > 0 {
+			if err := tm.reconnect(ctx, c, task, dests, broken); err != nil {
+				log.Printf("Task %s: reconnect failed: %v", task.Name, err)
+				break
+			}
+		}
+		for _, d := range retry {
+			d.err, d.w, d.fs = nil, nil, c.dsts[d.index]
+		}
+		pending = retry
+	}
+
+	delivered := true
+	for _, d := range ds {
+		if d.err != nil && ctx.Err() != nil {
+			// Not the file's fault; it is sent again on the next run
+			log.Printf("Aborted transfer of %s%s: %v", entry.Path, d.dest.label, d.err)
+			delivered = false
+			continue
+		}
+		if d.err != nil {
+			log.Printf("Failed to transfer %s%s: %v", entry.Path, d.dest.label, d.err)
+			f := d.dest.history.AddFailure(entry.Path, entry.Size, entry.ModTime, d.err, d.dest.task.QuarantineAfter)
+			if f.Quarantined {
+				log.Printf("Quarantined %s%s after %d failed runs; it is retried once the source file changes", entry.Path, d.dest.label, f.Count)
+			}
+			delivered = false
+			continue
+		}
+		d.dest.history.ClearFailure(entry.Path)
+		if d.conflict == conflictSkipped {
+			delivered = false
+			continue
+		}
+		tm.recordDelivery(ctx, d, entry)
+	}
+
+	// Only now that every target is complete may the source be touched
+	if delivered && file.partial {
+		if task.SourceAfterTransfer == "delete" || task.SourceAfterTransfer == "move" {
+			log.Printf("Keeping source %s: not every target has it yet", entry.Path)
+		}
+		delivered = false
+	}
+	if delivered {
+		if err := afterTransfer(ctx, c.src, entry, task); err != nil {
+			log.Printf("Failed to %s source %s: %v", task.SourceAfterTransfer, entry.Path, err)
+		}
+	}
+	return ds
+}
+
+// quarantined reports whether entry is held back from dest after too many
+// failed runs. A file whose source changed since is released.
+func quarantined(d *destination, entry protocols.FileEntry) bool {
+	f, ok := d.history.GetFailure(entry.Path)
+	if !ok || !f.Quarantined || d.task.QuarantineAfter <= 0 {
+		return false
+	}
+	if f.Size != entry.Size || !f.ModTime.Equal(entry.ModTime) {
+		log.Printf("Releasing %s%s from quarantine: source changed", entry.Path, d.label)
+		d.history.ClearFailure(entry.Path)
+		return false
+	}
+	log.Printf("Skipping %s%s: quarantined after %d failed runs (last error: %s)", entry.Path, d.label, f.Count, f.LastError)
+	return true
+}
+
+// recordDelivery logs a successful delivery, writes its per-file marker and
+// adds it to the destination's history.
+func (tm *TransferManager) recordDelivery(ctx context.Context, d *delivery, entry protocols.FileEntry) {
+	dest := d.dest
+	if d.target != entry.Path {
+		log.Printf("Transferred file: %s -> %s (size: %d)%s", entry.Path, d.target, entry.Size, dest.label)
+	} else {
+		log.Printf("Transferred file: %s (size: %d)%s", entry.Path, entry.Size, dest.label)
+	}
+
+	// Signal consumers that the file is complete
+	if dest.task.TargetMarker != "" && !isDirMarker(dest.task.TargetMarker) {
+		marker := targetMarkerPath(dest.task.TargetMarker, d.target)
+		if err := writeMarker(ctx, d.fs, marker); err != nil {
+			log.Printf("Failed to write marker %s%s: %v", marker, dest.label, err)
+		}
+	}
+
+	// Update History
+	rec := Record{
+		Size:     entry.Size,
+		ModTime:  entry.ModTime,
+		Hash:     d.digest,
+		Conflict: d.conflict,
+	}
+	if d.target != entry.Path {
+		rec.Target = d.target
+	}
+	dest.history.Add(entry.Path, rec)
+}
+
+// afterTransfer applies task.SourceAfterTransfer to a transferred source file
+// and its per-file marker. Directory markers are left to the producer.
+func afterTransfer(ctx context.Context, srcFS protocols.FileSystem, entry protocols.FileEntry, task config.Task) error {
+	if err := applySourceAction(ctx, srcFS, entry.Path, task); err != nil {
+		return err
+	}
+	if task.SourceMarker == "" || isDirMarker(task.SourceMarker) {
+		return nil
+	}
+	return applySourceAction(ctx, srcFS, path.Join(path.Dir(entry.Path), markerName(task.SourceMarker, entry.Name)), task)
+}
+
+func applySourceAction(ctx context.Context, srcFS protocols.FileSystem, relPath string, task config.Task) error {
+	switch task.SourceAfterTransfer {
+	case "", "keep":
+		return nil
+	case "delete":
+		if err := srcFS.Remove(ctx, relPath); err != nil {
+			return err
+		}
+		log.Printf("Deleted source file: %s", relPath)
+		return nil
+	case "move":
+		archivePath := path.Join(archiveDir(task), relPath)
+		if err := srcFS.MkdirAll(ctx, path.Dir(archivePath)); err != nil {
+			return err
+		}
+		if err := srcFS.Rename(ctx, relPath, archivePath); err != nil {
+			return err
+		}
+		log.Printf("Archived source file: %s -> %s", relPath, archivePath)
+		return nil
+	default:
+		return fmt.Errorf("unknown source_after_transfer: %s", task.SourceAfterTransfer)
+	}
+}
+
+// archiveDir is the source subfolder that "move" mode archives into.
+func archiveDir(task config.Task) string {
+	if task.SourceArchiveDir != "" {
+		return path.Clean(strings.Trim(task.SourceArchiveDir, "/"))
+	}
+	return "archive"
+}
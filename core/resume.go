@@ -0,0 +1,116 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+
+	"filetransferhx/protocols"
+)
+
+// resumeCheckSize is how much of the partial target's tail is compared with
+// the source before appending to it.
+const resumeCheckSize = 64 * 1024
+
+// openResume prepares to continue an interrupted transfer of entry into
+// writePath. It returns a source reader positioned at the end of the partial
+// target, a writer appending to it and the offset, or a zero offset if the
+// transfer has to start from scratch.
+//
+// The last resumeCheckSize bytes of the partial target are compared with the
+// same range of the source, so a partial file that belongs to an older
+// version of the source is rewritten instead of being extended.
+func openResume(ctx context.Context, srcFS, dstFS protocols.FileSystem, entry protocols.FileEntry, writePath string) (io.ReadCloser, io.WriteCloser, int64) {
+	srcRange, ok := srcFS.(protocols.RangeReader)
+	if !ok {
+		return nil, nil, 0
+	}
+	dstRange, ok := dstFS.(protocols.RangeReader)
+	if !ok {
+		return nil, nil, 0
+	}
+	dstAppend, ok := dstFS.(protocols.Appender)
+	if !ok {
+		return nil, nil, 0
+	}
+
+	partial, err := dstFS.Stat(ctx, writePath)
+	if err != nil || partial.IsDir || partial.Size <= 0 || partial.Size >= entry.Size {
+		return nil, nil, 0
+	}
+	offset := partial.Size
+	n := int64(resumeCheckSize)
+	if offset < n {
+		n = offset
+	}
+
+	dstTail, err := readRange(ctx, dstRange, writePath, offset-n, n)
+	if err != nil {
+		log.Printf("Cannot read partial target %s, restarting: %v", writePath, err)
+		return nil, nil, 0
+	}
+
+	srcFile, err := srcRange.OpenAt(ctx, entry.Path, offset-n)
+	if err != nil {
+		log.Printf("Cannot seek source %s, restarting: %v", entry.Path, err)
+		return nil, nil, 0
+	}
+	srcTail := make([]byte, n)
+	if _, err := io.ReadFull(srcFile, srcTail); err != nil || !bytes.Equal(srcTail, dstTail) {
+		srcFile.Close()
+		log.Printf("Partial target %s does not match source, restarting", writePath)
+		return nil, nil, 0
+	}
+
+	dstFile, err := dstAppend.Append(ctx, writePath)
+	if err != nil {
+		srcFile.Close()
+		log.Printf("Cannot append to %s, restarting: %v", writePath, err)
+		return nil, nil, 0
+	}
+	return srcFile, dstFile, offset
+}
+
+// isPartial reports whether target, size bytes long, is the beginning of
+// entry left by an interrupted transfer: it is shorter than the source and
+// its tail matches, as openResume checks before appending.
+func isPartial(ctx context.Context, srcFS, dstFS protocols.FileSystem, entry protocols.FileEntry, target string, size int64) bool {
+	srcRange, ok := srcFS.(protocols.RangeReader)
+	if !ok {
+		return false
+	}
+	dstRange, ok := dstFS.(protocols.RangeReader)
+	if !ok {
+		return false
+	}
+	if _, ok := dstFS.(protocols.Appender); !ok {
+		return false
+	}
+	if size <= 0 || size >= entry.Size {
+		return false
+	}
+	n := min(int64(resumeCheckSize), size)
+	dstTail, err := readRange(ctx, dstRange, target, size-n, n)
+	if err != nil {
+		return false
+	}
+	srcTail, err := readRange(ctx, srcRange, entry.Path, size-n, n)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(srcTail, dstTail)
+}
+
+func readRange(ctx context.Context, fs protocols.RangeReader, relPath string, offset, n int64) ([]byte, error) {
+	r, err := fs.OpenAt(ctx, relPath, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,157 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"filetransferhx/config"
+	"filetransferhx/protocols"
+)
+
+const (
+	defaultRetryBackoff    = time.Second
+	defaultRetryMaxBackoff = time.Minute
+)
+
+// Error classes that retry_on can list.
+const (
+	errClassNetwork    = "network"
+	errClassTimeout    = "timeout"
+	errClassNotFound   = "not_found"
+	errClassPermission = "permission"
+	errClassVerify     = "verify"
+	errClassOther      = "other"
+)
+
+// verifyError marks a target that did not match the source.
+type verifyError struct{ err error }
+
+func (e *verifyError) Error() string { return e.err.Error() }
+func (e *verifyError) Unwrap() error { return e.err }
+
+// errorClass sorts err into one of the classes retry_on refers to. Errors
+// that were flattened into strings on the way up are recognised by their
+// text as far as possible.
+func errorClass(err error) string {
+	var ve *verifyError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &ve):
+		return errClassVerify
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return errClassTimeout
+	case errors.Is(err, fs.ErrNotExist):
+		return errClassNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return errClassPermission
+	case errors.As(err, &netErr), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNABORTED), errors.Is(err, syscall.EPIPE):
+		return errClassNetwork
+	}
+
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "timeout"), strings.Contains(msg, "timed out"):
+		return errClassTimeout
+	case strings.Contains(msg, "connection reset"), strings.Contains(msg, "connection refused"),
+		strings.Contains(msg, "broken pipe"), strings.Contains(msg, "unexpected eof"),
+		strings.Contains(msg, "connection lost"), strings.Contains(msg, "use of closed network connection"):
+		return errClassNetwork
+	case strings.Contains(msg, "no such file"), strings.Contains(msg, "not found"):
+		return errClassNotFound
+	case strings.Contains(msg, "permission denied"):
+		return errClassPermission
+	}
+	return errClassOther
+}
+
+// retryPolicy applies defaults to a config.RetryPolicy.
+type retryPolicy struct {
+	config.RetryPolicy
+}
+
+func (p retryPolicy) attempts() int {
+	if p.Attempts < 1 {
+		return 1
+	}
+	return p.Attempts
+}
+
+// retryable reports whether err belongs to a class listed in retry_on.
+func (p retryPolicy) retryable(err error) bool {
+	classes := p.RetryOn
+	if len(classes) == 0 {
+		classes = []string{errClassNetwork, errClassTimeout}
+	}
+	class := errorClass(err)
+	for _, c := range classes {
+		if c == "all" || c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// delay returns how long to wait before attempt (2 for the first retry).
+func (p retryPolicy) delay(attempt int) time.Duration {
+	d := time.Duration(p.Backoff)
+	if d <= 0 {
+		d = defaultRetryBackoff
+	}
+	max := time.Duration(p.MaxBackoff)
+	if max <= 0 {
+		max = defaultRetryMaxBackoff
+	}
+	for i := 2; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if p.Jitter > 0 {
+		d = time.Duration(float64(d) * (1 + p.Jitter*(2*rand.Float64()-1)))
+	}
+	return d
+}
+
+// connect creates a file system, retrying according to task.ConnectRetry.
+func (tm *TransferManager) connect(ctx context.Context, task config.Task, fsType, rootPath string, auth *config.Auth) (protocols.FileSystem, error) {
+	policy := retryPolicy{task.ConnectRetry}
+	for attempt := 1; ; attempt++ {
+		fs, err := tm.createFileSystem(ctx, fsType, rootPath, auth)
+		if err == nil {
+			return fs, nil
+		}
+		if attempt >= policy.attempts() || !policy.retryable(err) {
+			return nil, err
+		}
+		wait := policy.delay(attempt + 1)
+		log.Printf("Task %s: connecting to %s failed (attempt %d/%d), retrying in %s: %v", task.Name, fsType, attempt, policy.attempts(), wait.Round(time.Millisecond), err)
+		if err := sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sleep waits for d, or returns ctx's error if it is cancelled first.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,105 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"filetransferhx/config"
+)
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&verifyError{errors.New("sha256 mismatch")}, errClassVerify},
+		{fmt.Errorf("upload: %w", &verifyError{errors.New("size mismatch")}), errClassVerify},
+		{context.DeadlineExceeded, errClassTimeout},
+		{os.ErrDeadlineExceeded, errClassTimeout},
+		{&net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}, errClassTimeout},
+		{&fs.PathError{Op: "open", Path: "a", Err: fs.ErrNotExist}, errClassNotFound},
+		{fmt.Errorf("open: %w", fs.ErrPermission), errClassPermission},
+		{&net.OpError{Op: "read", Err: syscall.ECONNRESET}, errClassNetwork},
+		{io.ErrUnexpectedEOF, errClassNetwork},
+		{fmt.Errorf("write: %w", syscall.EPIPE), errClassNetwork},
+		{errors.New("ssh: i/o timeout"), errClassTimeout},
+		{errors.New("connection lost"), errClassNetwork},
+		{errors.New("550 No such file or directory"), errClassNotFound},
+		{errors.New("sftp: Permission Denied"), errClassPermission},
+		{errors.New("disk full"), errClassOther},
+	}
+	for _, tt := range tests {
+		if got := errorClass(tt.err); got != tt.want {
+			t.Errorf("errorClass(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicyAttempts(t *testing.T) {
+	for attempts, want := range map[int]int{-1: 1, 0: 1, 1: 1, 5: 5} {
+		if got := (retryPolicy{config.RetryPolicy{Attempts: attempts}}).attempts(); got != want {
+			t.Errorf("attempts %d: got %d, want %d", attempts, got, want)
+		}
+	}
+}
+
+func TestRetryPolicyRetryable(t *testing.T) {
+	network := io.ErrUnexpectedEOF
+	missing := fs.ErrNotExist
+	tests := []struct {
+		retryOn []string
+		err     error
+		want    bool
+	}{
+		{nil, network, true},
+		{nil, context.DeadlineExceeded, true},
+		{nil, missing, false},
+		{[]string{"not_found"}, missing, true},
+		{[]string{"not_found"}, network, false},
+		{[]string{"all"}, errors.New("disk full"), true},
+	}
+	for _, tt := range tests {
+		p := retryPolicy{config.RetryPolicy{RetryOn: tt.retryOn}}
+		if got := p.retryable(tt.err); got != tt.want {
+			t.Errorf("retry_on %v, %v: got %v, want %v", tt.retryOn, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	seconds := func(n int) config.Duration { return config.Duration(time.Duration(n) * time.Second) }
+	tests := []struct {
+		name   string
+		policy config.RetryPolicy
+		want   []time.Duration // delays before attempts 2, 3, ...
+	}{
+		{"defaults", config.RetryPolicy{}, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}},
+		{"doubling", config.RetryPolicy{Backoff: seconds(3)}, []time.Duration{3 * time.Second, 6 * time.Second, 12 * time.Second}},
+		{"capped", config.RetryPolicy{Backoff: seconds(10), MaxBackoff: seconds(25)},
+			[]time.Duration{10 * time.Second, 20 * time.Second, 25 * time.Second, 25 * time.Second}},
+		{"backoff above cap", config.RetryPolicy{Backoff: seconds(90)}, []time.Duration{time.Minute}},
+	}
+	for _, tt := range tests {
+		p := retryPolicy{tt.policy}
+		for i, want := range tt.want {
+			if got := p.delay(i + 2); got != want {
+				t.Errorf("%s: delay(%d) = %v, want %v", tt.name, i+2, got, want)
+			}
+		}
+	}
+
+	p := retryPolicy{config.RetryPolicy{Backoff: seconds(10), Jitter: 0.2}}
+	for i := 0; i < 100; i++ {
+		if d := p.delay(2); d < 8*time.Second || d > 12*time.Second {
+			t.Fatalf("delay with 20%% jitter = %v, want within 8s-12s", d)
+		}
+	}
+}
@@ -1,7 +1,12 @@
 package core
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"reflect"
+	"sync"
+	"time"
 
 	"github.com/robfig/cron/v3"
 
@@ -12,42 +17,195 @@ type Runner struct {
 	Config          *config.Config
 	TransferManager *TransferManager
 	Cron            *cron.Cron
+
+	ctx       context.Context // cancelled by Stop
+	cancel    context.CancelFunc
+	immediate sync.WaitGroup // runs started by Start, which cron does not track
+
+	mu    sync.Mutex
+	tasks map[string]*scheduledTask // by task name
+}
+
+// scheduledTask is a task's cron entry. The job always runs the task's
+// current settings, so a reload only touches the entry when the schedule
+// or the overlap policy changed.
+type scheduledTask struct {
+	mu   sync.Mutex
+	task config.Task
+	id   cron.EntryID
+	job  cron.Job
+}
+
+func (s *scheduledTask) current() config.Task {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.task
+}
+
+func (s *scheduledTask) update(task config.Task) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.task = task
 }
 
 func NewRunner(cfg *config.Config, tm *TransferManager) *Runner {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Runner{
 		Config:          cfg,
 		TransferManager: tm,
 		Cron:            cron.New(),
+		ctx:             ctx,
+		cancel:          cancel,
+		tasks:           make(map[string]*scheduledTask),
 	}
 }
 
 func (r *Runner) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.TransferManager.SetBandwidth(r.Config.MaxBandwidth, r.Config.BandwidthWindows); err != nil {
+		log.Printf("Invalid global bandwidth settings, not limiting: %v", err)
+	}
+	r.TransferManager.SetShutdownGrace(time.Duration(r.Config.ShutdownGrace))
+
 	for _, task := range r.Config.Tasks {
-		task := task // capture loop variable
-		_, err := r.Cron.AddFunc(task.Cron, func() {
-			err := r.TransferManager.RunTask(task)
-			if err != nil {
-				log.Printf("Task %s failed: %v", task.Name, err)
-			}
-		})
+		s, err := r.schedule(task)
 		if err != nil {
 			log.Printf("Failed to schedule task %s: %v", task.Name, err)
-		} else {
-			log.Printf("Scheduled task %s with cron %s", task.Name, task.Cron)
+			continue
 		}
+		log.Printf("Scheduled task %s with cron %s", task.Name, task.Cron)
+		r.runNow(s)
+	}
+	r.Cron.Start()
+}
+
+// schedule adds a cron entry for task.
+func (r *Runner) schedule(task config.Task) (*scheduledTask, error) {
+	wrapper, err := overlapWrapper(task)
+	if err != nil {
+		return nil, err
+	}
+	s := &scheduledTask{task: task}
+	// The immediate run goes through the same wrapper, so it cannot
+	// overlap with the first tick either.
+	s.job = cron.NewChain(wrapper).Then(cron.FuncJob(func() {
+		// A run queued behind a running one may only get here after Stop
+		if r.ctx.Err() != nil {
+			return
+		}
+		task := s.current()
+		err := r.TransferManager.RunTask(r.ctx, task)
+		switch {
+		case err != nil && r.ctx.Err() != nil:
+			log.Printf("Task %s interrupted: %v", task.Name, err)
+		case err != nil:
+			log.Printf("Task %s failed: %v", task.Name, err)
+		}
+	}))
+	if s.id, err = r.Cron.AddJob(task.Cron, s.job); err != nil {
+		return nil, err
+	}
+	r.tasks[task.Name] = s
+	return s, nil
+}
 
-		// Run immediately in background
-		go func(t config.Task) {
-			log.Printf("Executing immediate run for task: %s", t.Name)
-			if err := r.TransferManager.RunTask(t); err != nil {
-				log.Printf("Immediate run of task %s failed: %v", t.Name, err)
+// runNow runs s in the background without waiting for its schedule.
+func (r *Runner) runNow(s *scheduledTask) {
+	r.immediate.Add(1)
+	go func() {
+		defer r.immediate.Done()
+		log.Printf("Executing immediate run for task: %s", s.current().Name)
+		s.job.Run()
+	}()
+}
+
+// Reload switches to cfg without a restart. Tasks are matched by name: new
+// ones are scheduled and run at once, removed ones are unscheduled, and
+// changed ones pick up their new settings from the next run on. Runs in
+// progress are not interrupted. If cfg is invalid nothing changes and the
+// error says why.
+func (r *Runner) Reload(cfg *config.Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ctx.Err() != nil {
+		return fmt.Errorf("runner is stopped")
+	}
+
+	if err := r.TransferManager.SetBandwidth(cfg.MaxBandwidth, cfg.BandwidthWindows); err != nil {
+		return err
+	}
+	r.TransferManager.SetShutdownGrace(time.Duration(cfg.ShutdownGrace))
+
+	keep := make(map[string]bool, len(cfg.Tasks))
+	for _, task := range cfg.Tasks {
+		keep[task.Name] = true
+		s, ok := r.tasks[task.Name]
+		if !ok {
+			s, err := r.schedule(task)
+			if err != nil {
+				log.Printf("Failed to schedule task %s: %v", task.Name, err)
+				continue
 			}
-		}(task)
+			log.Printf("Added task %s with cron %s", task.Name, task.Cron)
+			r.runNow(s)
+			continue
+		}
+
+		old := s.current()
+		if reflect.DeepEqual(old, task) {
+			continue
+		}
+		switch {
+		case old.Overlap != task.Overlap:
+			// A new wrapper does not know about a run of the old one
+			r.Cron.Remove(s.id)
+			if _, err := r.schedule(task); err != nil {
+				delete(r.tasks, task.Name)
+				log.Printf("Failed to reschedule task %s: %v", task.Name, err)
+				continue
+			}
+		case old.Cron != task.Cron:
+			r.Cron.Remove(s.id)
+			id, err := r.Cron.AddJob(task.Cron, s.job)
+			if err != nil {
+				delete(r.tasks, task.Name)
+				log.Printf("Failed to reschedule task %s: %v", task.Name, err)
+				continue
+			}
+			s.id = id
+		}
+		s.update(task)
+		log.Printf("Updated task %s (cron %s)", task.Name, task.Cron)
 	}
-	r.Cron.Start()
+
+	for name, s := range r.tasks {
+		if keep[name] {
+			continue
+		}
+		r.Cron.Remove(s.id)
+		delete(r.tasks, name)
+		log.Printf("Removed task %s", name)
+	}
+
+	r.Config = cfg
+	return nil
 }
 
+// Stop stops scheduling and waits for the running tasks: they start no new
+// files, and files in progress are aborted after the shutdown grace period.
+// History is safe to save once Stop returns.
 func (r *Runner) Stop() {
-	r.Cron.Stop()
+	r.mu.Lock()
+	r.cancel()
+	r.mu.Unlock()
+	stopped := r.Cron.Stop()
+	log.Printf("Waiting for running tasks to finish (grace period %s)", r.TransferManager.shutdownGrace())
+	<-stopped.Done()
+	r.immediate.Wait()
 }
@@ -0,0 +1,56 @@
+package core
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// defaultShutdownGrace applies when shutdown_grace is not set.
+const defaultShutdownGrace = 30 * time.Second
+
+// SetShutdownGrace sets how long files already being transferred may take
+// to finish once RunTask's context is cancelled. Zero restores the default.
+func (tm *TransferManager) SetShutdownGrace(d time.Duration) {
+	tm.grace.Store(int64(d))
+}
+
+func (tm *TransferManager) shutdownGrace() time.Duration {
+	if d := time.Duration(tm.grace.Load()); d > 0 {
+		return d
+	}
+	return defaultShutdownGrace
+}
+
+// withGrace returns a context that is cancelled grace after parent is, so
+// work already under way when shutdown begins gets a chance to finish.
+func withGrace(parent context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(parent))
+	stop := context.AfterFunc(parent, func() {
+		t := time.NewTimer(grace)
+		defer t.Stop()
+		select {
+		case <-t.C:
+			cancel()
+		case <-ctx.Done():
+		}
+	})
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// contextReader fails once ctx is cancelled, so a copy stops at the next
+// read even when the file system's stream does not watch ctx itself.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
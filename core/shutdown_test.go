@@ -0,0 +1,89 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"filetransferhx/config"
+	"filetransferhx/protocols"
+)
+
+// stalledFS is a source whose streams hang like a dead connection: reads
+// ignore ctx and only return once the file system is closed.
+type stalledFS struct {
+	protocols.LocalFileSystem
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (s *stalledFS) Open(ctx context.Context, path string) (io.ReadCloser, error) {
+	return io.NopCloser(stalledReader{s.closed}), nil
+}
+
+func (s *stalledFS) Close() error {
+	s.once.Do(func() { close(s.closed) })
+	return nil
+}
+
+type stalledReader struct{ closed chan struct{} }
+
+func (r stalledReader) Read(p []byte) (int, error) {
+	<-r.closed
+	return 0, errors.New("use of closed network connection")
+}
+
+func TestWithGrace(t *testing.T) {
+	parent, cancelParent := context.WithCancel(context.Background())
+	ctx, cancel := withGrace(parent, 50*time.Millisecond)
+	defer cancel()
+
+	cancelParent()
+	if ctx.Err() != nil {
+		t.Fatal("cancelled before the grace period")
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("not cancelled after the grace period")
+	}
+}
+
+func TestTransferAllClosesStalledConnections(t *testing.T) {
+	src := &stalledFS{closed: make(chan struct{})}
+	dst := &protocols.LocalFileSystem{RootPath: t.TempDir()}
+	task := config.Task{Name: "t", TargetType: "local"}
+
+	tm := newTestManager(t)
+	tm.SetShutdownGrace(100 * time.Millisecond)
+	filter, err := newFileFilter(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dests := []*destination{{task: task, fs: dst, history: tm.HistoryManager.GetTaskHistory("t"), filter: filter}}
+	scan := &scanResult{
+		files: []pendingFile{{entry: protocols.FileEntry{Name: "a", Path: "a", Size: 10}, dests: []int{0}}},
+		held:  make(map[markerDir]bool),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		tm.transferAll(ctx, src, dests, scan, task)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("transferAll still blocked long after the grace period")
+	}
+	if tm.HistoryManager.GetTaskHistory("t").Has("a") {
+		t.Error("aborted file recorded as transferred")
+	}
+}
@@ -0,0 +1,74 @@
+package core
+
+import (
+	"sync"
+	"time"
+
+	"filetransferhx/config"
+	"filetransferhx/protocols"
+)
+
+// observation is how a file looked when it was first seen with its current
+// size and ModTime.
+type observation struct {
+	size    int64
+	modTime time.Time
+	since   time.Time
+}
+
+// stabilityTracker remembers source listings across runs so files that are
+// still being written can be told apart from finished ones.
+type stabilityTracker struct {
+	mu   sync.Mutex
+	seen map[string]map[string]observation // task -> path -> observation
+}
+
+func newStabilityTracker() *stabilityTracker {
+	return &stabilityTracker{seen: make(map[string]map[string]observation)}
+}
+
+// isStable reports whether entry may be picked up:
+//
+//   - with min_age, once its ModTime is at least that old;
+//   - with stable_for, once two listings at least that far apart have shown
+//     the same size and ModTime.
+//
+// Either condition is enough. Without both options every file is stable.
+func (s *stabilityTracker) isStable(entry protocols.FileEntry, task config.Task, now time.Time) bool {
+	minAge := time.Duration(task.MinAge)
+	stableFor := time.Duration(task.StableFor)
+	if minAge <= 0 && stableFor <= 0 {
+		return true
+	}
+	if minAge > 0 && now.Sub(entry.ModTime) >= minAge {
+		return true
+	}
+	if stableFor <= 0 {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files, ok := s.seen[task.Name]
+	if !ok {
+		files = make(map[string]observation)
+		s.seen[task.Name] = files
+	}
+	obs, ok := files[entry.Path]
+	if !ok || obs.size != entry.Size || !obs.modTime.Equal(entry.ModTime) {
+		files[entry.Path] = observation{size: entry.Size, modTime: entry.ModTime, since: now}
+		return false
+	}
+	return now.Sub(obs.since) >= stableFor
+}
+
+// prune forgets files of a task that are no longer listed on the source.
+func (s *stabilityTracker) prune(taskName string, listed map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for p := range s.seen[taskName] {
+		if !listed[p] {
+			delete(s.seen[taskName], p)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package core
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"filetransferhx/protocols"
+)
+
+// templateVar matches a placeholder such as {yyyy}, {mtime:dd} or {1}.
+var templateVar = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// dateLayouts maps date placeholders to time.Format layouts.
+var dateLayouts = map[string]string{
+	"yyyy": "2006",
+	"MM":   "01",
+	"dd":   "02",
+	"HH":   "15",
+	"mm":   "04",
+	"ss":   "05",
+}
+
+// pathTemplate maps a source file to its target path according to
+// target_template. Supported placeholders:
+//
+//   - {yyyy} {MM} {dd} {HH} {mm} {ss}: transfer time
+//   - {mtime:yyyy} ... {mtime:ss}: the file's modification time
+//   - {task}: task name
+//   - {path}: relative path on the source, {dir}: its directory
+//   - {name}: base name, {stem}: base name without extension,
+//     {ext}: extension including the dot
+//   - {1}, {2}, ... and {groupname}: capture groups of source_regex
+type pathTemplate struct {
+	tmpl  string
+	task  string
+	regex *regexp.Regexp
+}
+
+// newPathTemplate checks every placeholder in tmpl; regex is source_regex.
+func newPathTemplate(tmpl, task string, regex *regexp.Regexp) (*pathTemplate, error) {
+	groups := make(map[string]bool)
+	for i, name := range regex.SubexpNames() {
+		if i == 0 {
+			continue
+		}
+		groups[strconv.Itoa(i)] = true
+		if name != "" {
+			groups[name] = true
+		}
+	}
+	for _, m := range templateVar.FindAllStringSubmatch(tmpl, -1) {
+		key := m[1]
+		if _, ok := dateLayouts[strings.TrimPrefix(key, "mtime:")]; ok {
+			continue
+		}
+		switch key {
+		case "task", "path", "dir", "name", "stem", "ext":
+			continue
+		}
+		if !groups[key] {
+			return nil, fmt.Errorf("unknown placeholder {%s} in target_template", key)
+		}
+	}
+	return &pathTemplate{tmpl: tmpl, task: task, regex: regex}, nil
+}
+
+// render returns the target path of entry transferred at now.
+func (t *pathTemplate) render(entry protocols.FileEntry, now time.Time) (string, error) {
+	name := path.Base(entry.Path)
+	ext := path.Ext(name)
+	dir := path.Dir(entry.Path)
+	if dir == "." {
+		dir = ""
+	}
+	captures := t.regex.FindStringSubmatch(name)
+
+	out := templateVar.ReplaceAllStringFunc(t.tmpl, func(s string) string {
+		key := s[1 : len(s)-1]
+		if layout, ok := dateLayouts[key]; ok {
+			return now.Format(layout)
+		}
+		if k, ok := strings.CutPrefix(key, "mtime:"); ok {
+			return entry.ModTime.Format(dateLayouts[k])
+		}
+		switch key {
+		case "task":
+			return t.task
+		case "path":
+			return entry.Path
+		case "dir":
+			return dir
+		case "name":
+			return name
+		case "stem":
+			return strings.TrimSuffix(name, ext)
+		case "ext":
+			return ext
+		}
+		if i, err := strconv.Atoi(key); err == nil {
+			if i < len(captures) {
+				return captures[i]
+			}
+			return ""
+		}
+		if i := t.regex.SubexpIndex(key); i >= 0 && i < len(captures) {
+			return captures[i]
+		}
+		return ""
+	})
+
+	target := path.Clean("/" + out)[1:]
+	if target == "" || strings.HasSuffix(out, "/") {
+		return "", fmt.Errorf("target_template produced no file name for %s", entry.Path)
+	}
+	return target, nil
+}
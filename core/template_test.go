@@ -0,0 +1,65 @@
+package core
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"filetransferhx/protocols"
+)
+
+func TestPathTemplateRender(t *testing.T) {
+	now := time.Date(2024, 1, 31, 15, 4, 5, 0, time.UTC)
+	mtime := time.Date(2023, 12, 24, 8, 30, 0, 0, time.UTC)
+	tests := []struct {
+		tmpl, regex, path string
+		want              string
+		wantErr           bool
+	}{
+		{tmpl: "{yyyy}/{MM}/{dd}/{name}", path: "in/a.csv", want: "2024/01/31/a.csv"},
+		{tmpl: "{HH}{mm}{ss}-{name}", path: "a.csv", want: "150405-a.csv"},
+		{tmpl: "{mtime:yyyy}-{mtime:MM}-{mtime:dd}/{name}", path: "a.csv", want: "2023-12-24/a.csv"},
+		{tmpl: "{task}/{path}", path: "in/a.csv", want: "t/in/a.csv"},
+		{tmpl: "{dir}/{stem}.bak{ext}", path: "in/sub/a.csv", want: "in/sub/a.bak.csv"},
+		{tmpl: "{dir}/{name}", path: "a.csv", want: "a.csv"},
+		{tmpl: "{stem}{ext}", path: "README", want: "README"},
+		{tmpl: `{2}/{1}.csv`, regex: `^(\w+)_(\d{4})\.csv$`, path: "sales_2024.csv", want: "2024/sales.csv"},
+		{tmpl: `{year}/{name}`, regex: `_(?P<year>\d{4})`, path: "x/sales_2024.csv", want: "2024/sales_2024.csv"},
+		{tmpl: `{1}/{name}`, regex: `^(a)?b`, path: "b.csv", want: "b.csv"},
+		{tmpl: "../../{name}", path: "a.csv", want: "a.csv"},
+		{tmpl: "{dir}/", path: "in/a.csv", wantErr: true},
+		{tmpl: "{dir}", path: "a.csv", wantErr: true},
+	}
+	for _, tt := range tests {
+		regex := regexp.MustCompile(tt.regex)
+		tmpl, err := newPathTemplate(tt.tmpl, "t", regex)
+		if err != nil {
+			t.Errorf("newPathTemplate(%q): %v", tt.tmpl, err)
+			continue
+		}
+		got, err := tmpl.render(protocols.FileEntry{Path: tt.path, ModTime: mtime}, now)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q for %s = %q, want an error", tt.tmpl, tt.path, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q for %s = %q, %v; want %q", tt.tmpl, tt.path, got, err, tt.want)
+		}
+	}
+}
+
+func TestNewPathTemplateRejectsUnknownPlaceholders(t *testing.T) {
+	tests := []struct{ tmpl, regex string }{
+		{"{year}/{name}", ""},
+		{"{mtime:yy}/{name}", ""},
+		{"{2}/{name}", `(\d+)`},
+		{"{day}/{name}", `(?P<year>\d+)`},
+	}
+	for _, tt := range tests {
+		if _, err := newPathTemplate(tt.tmpl, "t", regexp.MustCompile(tt.regex)); err == nil {
+			t.Errorf("newPathTemplate(%q, %q): no error", tt.tmpl, tt.regex)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"filetransferhx/config"
+)
+
+// throttleChunk is the most a throttled reader hands out per Read, so the
+// limiter is consulted often enough to keep the rate smooth.
+const throttleChunk = 32 * 1024
+
+// bandwidthLimiter is a token bucket whose rate follows max_bandwidth and
+// its time windows. It is shared by every transfer it applies to.
+type bandwidthLimiter struct {
+	spec    string // settings it was built from, to notice config changes
+	base    int64
+	windows []bandwidthWindow
+
+	mu      sync.Mutex
+	limit   int64 // bytes per second currently in effect, 0 = unlimited
+	limiter *rate.Limiter
+}
+
+// bandwidthWindow is a parsed config.BandwidthWindow, in minutes of the day.
+type bandwidthWindow struct {
+	from, to int
+	limit    int64
+}
+
+func (w bandwidthWindow) contains(minute int) bool {
+	if w.from <= w.to {
+		return minute >= w.from && minute < w.to
+	}
+	// Spans midnight, e.g. 22:00-06:00
+	return minute >= w.from || minute < w.to
+}
+
+func newBandwidthLimiter(max config.ByteSize, windows []config.BandwidthWindow) (*bandwidthLimiter, error) {
+	b := &bandwidthLimiter{
+		spec: bandwidthSpec(max, windows),
+		base: int64(max),
+	}
+	for _, w := range windows {
+		from, err := parseClock(w.From)
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseClock(w.To)
+		if err != nil {
+			return nil, err
+		}
+		b.windows = append(b.windows, bandwidthWindow{from: from, to: to, limit: int64(w.MaxBandwidth)})
+	}
+	return b, nil
+}
+
+// enabled reports whether any limit is configured at all.
+func (b *bandwidthLimiter) enabled() bool {
+	return b.base > 0 || len(b.windows) > 0
+}
+
+func bandwidthSpec(max config.ByteSize, windows []config.BandwidthWindow) string {
+	return fmt.Sprint(max, windows)
+}
+
+// parseClock parses "HH:MM" into minutes of the day.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// current returns the bucket for the limit in effect at now, or nil if
+// transfers are unlimited at that time.
+func (b *bandwidthLimiter) current(now time.Time) *rate.Limiter {
+	limit := b.base
+	minute := now.Hour()*60 + now.Minute()
+	for _, w := range b.windows {
+		if w.contains(minute) {
+			limit = w.limit
+			break
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if limit != b.limit {
+		b.limit = limit
+		if limit > 0 {
+			// A second's worth of burst, but at least one chunk
+			burst := int(limit)
+			if burst < throttleChunk {
+				burst = throttleChunk
+			}
+			if b.limiter == nil {
+				b.limiter = rate.NewLimiter(rate.Limit(limit), burst)
+			} else {
+				b.limiter.SetLimit(rate.Limit(limit))
+				b.limiter.SetBurst(burst)
+			}
+		}
+	}
+	if limit <= 0 {
+		return nil
+	}
+	return b.limiter
+}
+
+// wait blocks until n more bytes may pass or ctx is cancelled.
+func (b *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	l := b.current(time.Now())
+	if l == nil {
+		return nil
+	}
+	for n > 0 {
+		k := n
+		if burst := l.Burst(); k > burst {
+			k = burst
+		}
+		if err := l.WaitN(ctx, k); err != nil {
+			return err
+		}
+		n -= k
+	}
+	return nil
+}
+
+// throttledReader paces reads through every limiter that applies.
+type throttledReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*bandwidthLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := t.r.Read(p)
+	for _, l := range t.limiters {
+		if werr := l.wait(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// SetBandwidth sets the process-wide limit shared by all tasks.
+func (tm *TransferManager) SetBandwidth(max config.ByteSize, windows []config.BandwidthWindow) error {
+	l, err := newBandwidthLimiter(max, windows)
+	if err != nil {
+		return err
+	}
+	tm.limitMu.Lock()
+	defer tm.limitMu.Unlock()
+	tm.bandwidth = l
+	return nil
+}
+
+// taskLimiter returns the limiter shared by all runs of task, rebuilding it
+// when the task's settings changed.
+func (tm *TransferManager) taskLimiter(task config.Task) (*bandwidthLimiter, error) {
+	tm.limitMu.Lock()
+	defer tm.limitMu.Unlock()
+	spec := bandwidthSpec(task.MaxBandwidth, task.BandwidthWindows)
+	if l, ok := tm.taskLimits[task.Name]; ok && l.spec == spec {
+		return l, nil
+	}
+	l, err := newBandwidthLimiter(task.MaxBandwidth, task.BandwidthWindows)
+	if err != nil {
+		return nil, err
+	}
+	tm.taskLimits[task.Name] = l
+	return l, nil
+}
+
+// throttle wraps r in the task's and the process-wide limits, if any.
+func (tm *TransferManager) throttle(ctx context.Context, r io.Reader, task config.Task) io.Reader {
+	var limiters []*bandwidthLimiter
+	tm.limitMu.Lock()
+	if l := tm.taskLimits[task.Name]; l != nil && l.enabled() {
+		limiters = append(limiters, l)
+	}
+	if l := tm.bandwidth; l != nil && l.enabled() {
+		limiters = append(limiters, l)
+	}
+	tm.limitMu.Unlock()
+	if len(limiters) == 0 {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, limiters: limiters}
+}
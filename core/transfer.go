@@ -1,11 +1,14 @@
 package core
 
 import (
+	"context"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
 	"path"
-	"regexp"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"filetransferhx/config"
@@ -14,43 +17,95 @@ import (
 
 type TransferManager struct {
 	HistoryManager *HistoryManager
+	stability      *stabilityTracker
+	grace          atomic.Int64 // see SetShutdownGrace
+
+	limitMu    sync.Mutex
+	bandwidth  *bandwidthLimiter            // process-wide, see SetBandwidth
+	taskLimits map[string]*bandwidthLimiter // per task name
 }
 
 func NewTransferManager(hm *HistoryManager) *TransferManager {
 	return &TransferManager{
 		HistoryManager: hm,
+		stability:      newStabilityTracker(),
+		taskLimits:     make(map[string]*bandwidthLimiter),
 	}
 }
 
-func (tm *TransferManager) RunTask(task config.Task) error {
+// RunTask runs task once. Cancelling ctx stops it from starting new files;
+// those already under way get the shutdown grace period to finish before
+// they are aborted. An interrupted run returns ctx's error.
+func (tm *TransferManager) RunTask(ctx context.Context, task config.Task) error {
 	log.Printf("Starting task: %s", task.Name)
 
+	// Configs are validated when loaded; this catches tasks built otherwise
+	if err := task.Validate(); err != nil {
+		return fmt.Errorf("invalid task: %v", err)
+	}
+	if _, err := tm.taskLimiter(task); err != nil {
+		return fmt.Errorf("invalid bandwidth_windows: %v", err)
+	}
+
 	// 1. Init FileSystems
-	srcFS, err := tm.createFileSystem(task.SourceType, task.SourcePath, task.SourceAuth)
+	srcFS, err := tm.connect(ctx, task, task.SourceType, task.SourcePath, task.SourceAuth)
 	if err != nil {
 		return fmt.Errorf("failed to init source fs: %v", err)
 	}
 	defer srcFS.Close()
 
-	dstFS, err := tm.createFileSystem(task.TargetType, task.TargetPath, task.TargetAuth)
+	// 2. Targets, each with its own connection and history
+	dests, missing, err := tm.openDestinations(ctx, task)
 	if err != nil {
-		return fmt.Errorf("failed to init target fs: %v", err)
+		return err
+	}
+	for _, d := range dests {
+		defer d.fs.Close()
 	}
-	defer dstFS.Close()
-
-	// 2. Load History
-	history := tm.HistoryManager.GetTaskHistory(task.Name)
 
 	// 3. Traverse and Transfer
-	err = tm.processDirectory(srcFS, dstFS, "", task, history)
+	filter, err := newFileFilter(task)
+	if err != nil {
+		return err
+	}
+	scan := &scanResult{seen: make(map[string]bool), held: make(map[markerDir]bool), targetsMissing: missing}
+	err = tm.processDirectory(ctx, srcFS, "", task, dests, filter, scan)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 	if err != nil {
 		log.Printf("Error processing directory for task %s: %v", task.Name, err)
-		// Continue to cleanup even if transfer failed partially
+		scan.incomplete = true
+		// Continue to transfer what was found and to cleanup
+	}
+	if !scan.incomplete {
+		tm.stability.prune(task.Name, scan.seen)
+	}
+	if err := orderFiles(scan.files, task.Order); err != nil {
+		return err
 	}
+	batch := limitBatch(scan.files, task)
+	for _, f := range scan.files[len(batch):] {
+		scan.hold(dests, f.dests, f.entry)
+	}
+	scan.files = batch
+	tm.transferAll(ctx, srcFS, dests, scan, task)
+	if ctx.Err() != nil {
+		// Keep what was transferred, but delete nothing on the way out
+		tm.HistoryManager.Save()
+		return ctx.Err()
+	}
+
+	for _, d := range dests {
+		// Propagate deletions
+		if task.Mode == "mirror" {
+			tm.mirror(ctx, d.fs, d.task, d.history, d.filter, scan)
+		}
 
-	// 4. Cleanup
-	if task.RetentionDays > 0 {
-		tm.cleanup(dstFS, task, history)
+		// 4. Cleanup
+		if task.RetentionDays > 0 {
+			tm.cleanup(ctx, d.fs, d.task, d.history)
+		}
 	}
 
 	// 5. Save History
@@ -59,67 +114,201 @@ func (tm *TransferManager) RunTask(task config.Task) error {
 	return nil
 }
 
-func (tm *TransferManager) createFileSystem(fsType, rootPath string, auth *config.Auth) (protocols.FileSystem, error) {
+func (tm *TransferManager) createFileSystem(ctx context.Context, fsType, rootPath string, auth *config.Auth) (protocols.FileSystem, error) {
 	switch fsType {
 	case "local":
 		fs := &protocols.LocalFileSystem{RootPath: rootPath}
-		return fs, fs.Init()
+		return fs, fs.Init(ctx)
 	case "sftp":
 		if auth == nil {
 			return nil, fmt.Errorf("auth required for sftp")
 		}
 		fs := &protocols.SFTPFileSystem{
+			Host:        auth.Host,
+			Port:        auth.Port,
+			User:        auth.User,
+			Password:    auth.Password,
+			RootPath:    rootPath,
+			PrivateKey:  auth.PrivateKey,
+			Passphrase:  auth.PrivateKeyPassphrase,
+			UseAgent:    auth.UseAgent,
+			AuthMethods: auth.AuthMethods,
+
+			HostKeyCheck:        auth.HostKeyCheck,
+			KnownHosts:          auth.KnownHosts,
+			HostKeyFingerprints: auth.HostKeyFingerprints,
+		}
+		return fs, fs.Init(ctx)
+	case "ftp":
+		if auth == nil {
+			return nil, fmt.Errorf("auth required for ftp")
+		}
+		fs := &protocols.FTPFileSystem{
 			Host:     auth.Host,
 			Port:     auth.Port,
 			User:     auth.User,
 			Password: auth.Password,
 			RootPath: rootPath,
 		}
-		return fs, fs.Init()
-	case "ftp":
+		return fs, fs.Init(ctx)
+	case "ftps":
 		if auth == nil {
-			return nil, fmt.Errorf("auth required for ftp")
+			return nil, fmt.Errorf("auth required for ftps")
+		}
+		mode := auth.TLSMode
+		if mode == "" {
+			mode = "explicit"
+		}
+		port := auth.Port
+		if port == 0 {
+			port = 21
+			if mode == "implicit" {
+				port = 990
+			}
 		}
 		fs := &protocols.FTPFileSystem{
 			Host:     auth.Host,
-			Port:     auth.Port,
+			Port:     port,
+			User:     auth.User,
+			Password: auth.Password,
+			RootPath: rootPath,
+			TLSMode:  mode,
+			TLS:      tlsOptions(auth),
+		}
+		return fs, fs.Init(ctx)
+	case "s3":
+		if auth == nil {
+			return nil, fmt.Errorf("auth required for s3")
+		}
+		fs := &protocols.S3FileSystem{
+			Endpoint:  auth.Endpoint,
+			Region:    auth.Region,
+			Bucket:    auth.Bucket,
+			Prefix:    rootPath,
+			AccessKey: auth.AccessKey,
+			SecretKey: auth.SecretKey,
+			PathStyle: auth.PathStyle,
+			TLS:       tlsOptions(auth),
+		}
+		return fs, fs.Init(ctx)
+	case "webdav":
+		if auth == nil {
+			return nil, fmt.Errorf("auth required for webdav")
+		}
+		fs := &protocols.WebDAVFileSystem{
+			Endpoint: auth.Endpoint,
 			User:     auth.User,
 			Password: auth.Password,
+			AuthType: auth.AuthType,
 			RootPath: rootPath,
+			TLS:      tlsOptions(auth),
 		}
-		return fs, fs.Init()
+		return fs, fs.Init(ctx)
 	default:
 		return nil, fmt.Errorf("unknown fs type: %s", fsType)
 	}
 }
 
-func (tm *TransferManager) processDirectory(srcFS, dstFS protocols.FileSystem, relPath string, task config.Task, history *TaskHistory) error {
-	entries, err := srcFS.List(relPath)
+func tlsOptions(auth *config.Auth) protocols.TLSOptions {
+	return protocols.TLSOptions{
+		CACert:             auth.CACert,
+		ClientCert:         auth.ClientCert,
+		ClientKey:          auth.ClientKey,
+		MinVersion:         auth.TLSMinVersion,
+		InsecureSkipVerify: auth.InsecureSkipVerify,
+	}
+}
+
+// scanResult is what processDirectory found on the source.
+type scanResult struct {
+	files          []pendingFile   // matching files not transferred yet
+	seen           map[string]bool // every path matching source_regex
+	incomplete     bool            // some directory could not be listed
+	targetsMissing bool            // some target could not be opened this run
+	// Target directories with files that wait for a later run, which keeps
+	// their directory markers from being written
+	held map[markerDir]bool
+}
+
+// hold records that entry is not transferred to the destinations listed in
+// which this run.
+func (s *scanResult) hold(dests []*destination, which []int, entry protocols.FileEntry) {
+	now := time.Now()
+	for _, i := range which {
+		d := dests[i]
+		if d.task.TargetMarker == "" || !isDirMarker(d.task.TargetMarker) {
+			continue
+		}
+		target, err := d.targetPath(entry, now)
+		if err != nil {
+			continue
+		}
+		s.held[markerDir{dest: i, dir: path.Dir(target)}] = true
+	}
+}
+
+// pendingFile is a source file and the destinations (indexes into the
+// task's destinations) that still need it.
+type pendingFile struct {
+	entry protocols.FileEntry
+	dests []int
+	// Some target that may need the file does not get it this run, so the
+	// source has to stay for a later one
+	partial bool
+}
+
+// processDirectory walks relPath recursively and collects the files that
+// still need to be transferred.
+func (tm *TransferManager) processDirectory(ctx context.Context, srcFS protocols.FileSystem, relPath string, task config.Task, dests []*destination, filter *fileFilter, scan *scanResult) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	entries, err := srcFS.List(ctx, relPath)
 	if err != nil {
 		return err
 	}
 
-	regex, err := regexp.Compile(task.SourceRegex)
-	if err != nil {
-		return fmt.Errorf("invalid regex: %v", err)
+	// Markers are looked up in the same listing
+	var names map[string]bool
+	if task.SourceMarker != "" {
+		names = make(map[string]bool, len(entries))
+		for _, entry := range entries {
+			if !entry.IsDir {
+				names[entry.Name] = true
+			}
+		}
 	}
 
 	for _, entry := range entries {
 		entryRelPath := path.Join(relPath, entry.Name)
 
 		if entry.IsDir {
+			// Never pick up files that were already archived
+			if task.SourceAfterTransfer == "move" && entryRelPath == archiveDir(task) {
+				continue
+			}
+			// Excluded subtrees are never listed
+			if !filter.descend(entryRelPath) {
+				continue
+			}
+
 			// Recursion
-			err := tm.processDirectory(srcFS, dstFS, entryRelPath, task, history)
+			err := tm.processDirectory(ctx, srcFS, entryRelPath, task, dests, filter, scan)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			if err != nil {
 				log.Printf("Error processing subdir %s: %v", entryRelPath, err)
+				scan.incomplete = true
 			}
 			continue
 		}
 
 		// Filter
-		if !regex.MatchString(entry.Name) {
+		if !filter.match(entryRelPath) {
 			continue
 		}
+		scan.seen[entryRelPath] = true
 
 		// Filter by ModTime
 		if task.SourceNewerDays > 0 {
@@ -129,78 +318,274 @@ func (tm *TransferManager) processDirectory(srcFS, dstFS protocols.FileSystem, r
 			}
 		}
 
+		// Filter by Size
+		if entry.Size < int64(task.MinSize) || (task.MaxSize > 0 && entry.Size > int64(task.MaxSize)) {
+			continue
+		}
+
 		// Check History
-		if history.Has(entryRelPath) {
-			// Already transferred
-			// Optional: Check ModTime or Size to see if it changed?
-			// For now, strict "avoid duplicate" based on history record.
+		entry.Path = entryRelPath
+		var need []int
+		partial := scan.targetsMissing
+		for i, d := range dests {
+			send, err := needsTransfer(ctx, srcFS, entry, d.task, d.history)
+			if err != nil {
+				log.Printf("Failed to check %s%s: %v", entryRelPath, d.label, err)
+				partial = true
+				scan.hold(dests, []int{i}, entry)
+				continue
+			}
+			if !send {
+				continue
+			}
+			if quarantined(d, entry) {
+				partial = true
+				scan.hold(dests, []int{i}, entry)
+				continue
+			}
+			need = append(need, i)
+		}
+		if len(need) == 0 {
 			continue
 		}
 
-		// Transfer
-		err := tm.transferFile(srcFS, dstFS, entryRelPath)
-		if err != nil {
-			log.Printf("Failed to transfer %s: %v", entryRelPath, err)
+		// Wait for the producer to signal the file is complete
+		if task.SourceMarker != "" && !hasSourceMarker(task.SourceMarker, entry.Name, names) {
+			log.Printf("Skipping %s: marker not present yet", entryRelPath)
+			scan.hold(dests, need, entry)
+			continue
+		}
+
+		// Leave files that are still being written for a later run
+		if !tm.stability.isStable(entry, task, time.Now()) {
+			log.Printf("Skipping %s: not stable yet (size: %d)", entryRelPath, entry.Size)
+			scan.hold(dests, need, entry)
 			continue
 		}
-		log.Printf("Transferred file: %s (size: %d)", entryRelPath, entry.Size)
 
-		// Update History
-		history.Add(entryRelPath)
+		scan.files = append(scan.files, pendingFile{entry: entry, dests: need, partial: partial})
 	}
 	return nil
 }
 
-func (tm *TransferManager) transferFile(srcFS, dstFS protocols.FileSystem, relPath string) error {
-	// Ensure parent dir exists in target
-	parentDir := path.Dir(relPath)
-	if parentDir != "." && parentDir != "/" {
-		err := dstFS.MkdirAll(parentDir)
-		if err != nil {
-			return fmt.Errorf("failed to mkdir %s: %v", parentDir, err)
+// transferFile copies entry to every delivery in ds, reading the source once,
+// and returns the source digest ("sha256:<hex>") when one was computed for
+// verification or change detection. A failure of a single target is
+// recorded in its delivery; an error is returned when the source itself
+// could not be read or no target is left.
+func (tm *TransferManager) transferFile(ctx context.Context, srcFS protocols.FileSystem, entry protocols.FileEntry, ds []*delivery, task config.Task) (string, error) {
+	relPath := entry.Path
+
+	for _, d := range ds {
+		// Ensure parent dir exists in target
+		parentDir := path.Dir(d.target)
+		if parentDir != "." && parentDir != "/" {
+			err := d.fs.MkdirAll(ctx, parentDir)
+			if err != nil {
+				d.fail(fmt.Errorf("failed to mkdir %s: %v", parentDir, err))
+				continue
+			}
+		}
+
+		// Target is written under a temporary name in atomic mode
+		d.writePath = d.target
+		if task.AtomicWrite {
+			d.writePath = tempPath(d.target, task)
+		}
+	}
+	live := liveDeliveries(ds)
+	if len(live) == 0 {
+		return "", ds[0].err
+	}
+
+	// Continue a partial target left by an interrupted run. Only a file
+	// going to a single target can be resumed, as all targets share one read.
+	var srcFile io.ReadCloser
+	var offset int64
+	if task.Resume && len(live) == 1 {
+		var dstFile io.WriteCloser
+		srcFile, dstFile, offset = openResume(ctx, srcFS, live[0].fs, entry, live[0].writePath)
+		if offset > 0 {
+			live[0].w = dstFile
+			log.Printf("Resuming %s at offset %d", relPath, offset)
 		}
 	}
 
-	// Open Source
-	srcFile, err := srcFS.Open(relPath)
-	if err != nil {
-		return err
+	if offset == 0 {
+		// Open Source
+		var err error
+		srcFile, err = srcFS.Open(ctx, relPath)
+		if err != nil {
+			return "", err
+		}
+
+		// Create Targets
+		for _, d := range live {
+			if d.w, err = d.fs.Create(ctx, d.writePath); err != nil {
+				d.fail(err)
+			}
+		}
+		if live = liveDeliveries(ds); len(live) == 0 {
+			srcFile.Close()
+			return "", ds[0].err
+		}
 	}
 	defer srcFile.Close()
 
-	// Create Target
-	dstFile, err := dstFS.Create(relPath)
+	// Hash the source while it streams, unless only the tail is streamed
+	algo := hashAlgorithm(task)
+	h, err := newVerifyHash(algo)
 	if err != nil {
-		return err
+		for _, d := range live {
+			d.fail(err)
+		}
+		return "", err
+	}
+	var reader io.Reader = contextReader{ctx, srcFile}
+	if h != nil && offset == 0 {
+		reader = io.TeeReader(reader, h)
 	}
-	defer dstFile.Close()
+	reader = tm.throttle(ctx, reader, task)
 
 	// Copy
-	_, err = io.Copy(dstFile, srcFile)
-	return err
+	var n int64
+	if len(live) == 1 {
+		// io.Copy lets a single target use its ReaderFrom (e.g. concurrent SFTP writes)
+		n, err = io.Copy(live[0].w, reader)
+	} else {
+		n, err = copyToAll(reader, live, task.TargetParallel)
+	}
+	if err != nil {
+		for _, d := range live {
+			d.fail(err)
+		}
+		return "", err
+	}
+	for _, d := range liveDeliveries(ds) {
+		err := d.w.Close()
+		d.w = nil
+		if err != nil {
+			d.fail(err)
+		}
+	}
+	// Release the source (an FTP connection can only serve one transfer)
+	// before it may be read again for verification.
+	srcFile.Close()
+
+	var digest string
+	if h != nil {
+		if offset == 0 {
+			digest = hex.EncodeToString(h.Sum(nil))
+		} else if digest, err = hashFile(ctx, srcFS, relPath, algo); err != nil {
+			err = fmt.Errorf("failed to hash source: %v", err)
+			for _, d := range liveDeliveries(ds) {
+				d.fail(err)
+			}
+			return "", err
+		}
+	}
+
+	eachLive(ds, task.TargetParallel, func(d *delivery) {
+		if err := finishDelivery(ctx, d, entry, task, offset, offset+n, algo, digest); err != nil {
+			d.fail(err)
+		}
+	})
+
+	if digest == "" {
+		return "", nil
+	}
+	return algo + ":" + digest, nil
+}
+
+// finishDelivery checks a written target and moves it into place. size is
+// what the target should hold; offset is where a resumed transfer started.
+func finishDelivery(ctx context.Context, d *delivery, entry protocols.FileEntry, task config.Task, offset, size int64, algo, digest string) error {
+	dstFS := d.fs
+
+	// A resumed file must end up exactly as long as the source
+	if offset > 0 && task.Verify == "" {
+		st, err := dstFS.Stat(ctx, d.writePath)
+		if err != nil {
+			return fmt.Errorf("failed to stat resumed %s: %v", d.writePath, err)
+		}
+		if st.Size != entry.Size {
+			dstFS.Remove(ctx, d.writePath)
+			return fmt.Errorf("resumed %s has size %d, expected %d", d.writePath, st.Size, entry.Size)
+		}
+	}
+
+	// Verify before the file becomes visible under its final name
+	if task.Verify != "" {
+		verifyDigest := ""
+		if task.Verify == algo {
+			verifyDigest = digest
+		}
+		if err := verifyTarget(ctx, dstFS, d.writePath, task.Verify, size, verifyDigest); err != nil {
+			dstFS.Remove(ctx, d.writePath)
+			return &verifyError{fmt.Errorf("verification of %s failed: %v", entry.Path, err)}
+		}
+	}
+
+	if d.writePath != d.target {
+		if err := dstFS.Rename(ctx, d.writePath, d.target); err != nil {
+			return fmt.Errorf("failed to rename %s to %s: %v", d.writePath, d.target, err)
+		}
+	}
+	return nil
+}
+
+// tempPath returns the name a file is written under before it is renamed
+// into place, e.g. "dir/report.csv.part".
+func tempPath(relPath string, task config.Task) string {
+	prefix, suffix := tempAffixes(task)
+	return path.Join(path.Dir(relPath), prefix+path.Base(relPath)+suffix)
 }
 
-func (tm *TransferManager) cleanup(dstFS protocols.FileSystem, task config.Task, history *TaskHistory) {
+func tempAffixes(task config.Task) (prefix, suffix string) {
+	prefix, suffix = task.TempPrefix, task.TempSuffix
+	if prefix == "" && suffix == "" {
+		suffix = ".part"
+	}
+	return prefix, suffix
+}
+
+// abortWrite closes a target writer after a failed copy. Writers that upload
+// in the background (FTP, S3, WebDAV) are told to abort instead of
+// committing what was received so far.
+func abortWrite(w io.WriteCloser, err error) {
+	if a, ok := w.(interface{ CloseWithError(error) error }); ok {
+		a.CloseWithError(err)
+		return
+	}
+	w.Close()
+}
+
+func (tm *TransferManager) cleanup(ctx context.Context, dstFS protocols.FileSystem, task config.Task, history *TaskHistory) {
 	cutoff := time.Now().AddDate(0, 0, -task.RetentionDays)
 
+	// Keyed by target path, which differs from the source path with target_template
 	history.mu.RLock()
 	records := make(map[string]time.Time, len(history.Records))
 	for k, v := range history.Records {
-		records[k] = v
+		if v.Conflict == conflictSkipped {
+			// Not ours to delete
+			continue
+		}
+		records[v.target(k)] = v.TransferTime
 	}
 	history.mu.RUnlock()
 
 	for relPath, transferTime := range records {
 		if transferTime.Before(cutoff) {
 			// Check if file exists before trying to delete
-			_, err := dstFS.Stat(relPath)
+			_, err := dstFS.Stat(ctx, relPath)
 			if err != nil {
 				// File likely doesn't exist, skip
 				continue
 			}
 
 			log.Printf("Cleaning up old file: %s (transferred at %v)", relPath, transferTime)
-			err = dstFS.Remove(relPath)
+			err = dstFS.Remove(ctx, relPath)
 			if err != nil {
 				log.Printf("Failed to remove %s: %v", relPath, err)
 			}
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"filetransferhx/config"
+)
+
+// newTestManager returns a TransferManager whose history lives in a
+// temporary directory.
+func newTestManager(t *testing.T) *TransferManager {
+	t.Helper()
+	return NewTransferManager(NewHistoryManager(filepath.Join(t.TempDir(), "history.json")))
+}
+
+// writeFiles creates each file under root with the given content.
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func fileExists(root, name string) bool {
+	_, err := os.Stat(filepath.Join(root, filepath.FromSlash(name)))
+	return err == nil
+}
+
+// unreachablePort returns a local port nothing listens on.
+func unreachablePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+func TestRunTaskKeepsSourceWhileTargetIsDown(t *testing.T) {
+	src, a, c := t.TempDir(), t.TempDir(), t.TempDir()
+	writeFiles(t, src, map[string]string{"a.csv": "a"})
+
+	task := config.Task{
+		Name:                "t",
+		Cron:                "@hourly",
+		SourceType:          "local",
+		SourcePath:          src,
+		SourceRegex:         `\.csv$`,
+		SourceAfterTransfer: "delete",
+		Targets: []config.Target{
+			{Name: "A", TargetType: "local", TargetPath: a},
+			{Name: "C", TargetType: "sftp", TargetPath: "/", TargetAuth: &config.Auth{Host: "127.0.0.1", Port: unreachablePort(t), User: "u"}},
+		},
+	}
+	tm := newTestManager(t)
+	if err := tm.RunTask(context.Background(), task); err != nil {
+		t.Fatal(err)
+	}
+	if !fileExists(a, "a.csv") {
+		t.Fatal("a.csv not delivered to A")
+	}
+	if !fileExists(src, "a.csv") {
+		t.Fatal("source deleted although C never got it")
+	}
+
+	// Once C is back it gets the file, and only then is the source deleted
+	task.Targets[1] = config.Target{Name: "C", TargetType: "local", TargetPath: c}
+	if err := tm.RunTask(context.Background(), task); err != nil {
+		t.Fatal(err)
+	}
+	if !fileExists(c, "a.csv") {
+		t.Fatal("a.csv not delivered to C")
+	}
+	if fileExists(src, "a.csv") {
+		t.Fatal("source kept after every target got it")
+	}
+}
+
+func TestRunTaskRejectsMirrorWithSourceAction(t *testing.T) {
+	for _, action := range []string{"delete", "move"} {
+		task := config.Task{
+			Name:                "t",
+			Cron:                "@hourly",
+			Mode:                "mirror",
+			SourceAfterTransfer: action,
+			SourceType:          "local",
+			SourcePath:          t.TempDir(),
+			TargetType:          "local",
+			TargetPath:          t.TempDir(),
+		}
+		if err := newTestManager(t).RunTask(context.Background(), task); err == nil {
+			t.Errorf("mirror with source_after_transfer = %s: no error", action)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package core
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"strings"
+
+	"filetransferhx/protocols"
+)
+
+// newVerifyHash returns the hash used for task.Verify, or nil when the mode
+// does not need one ("" and "size").
+func newVerifyHash(mode string) (hash.Hash, error) {
+	switch mode {
+	case "", "size":
+		return nil, nil
+	case "md5":
+		return md5.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	default:
+		return nil, fmt.Errorf("unknown verify mode: %s", mode)
+	}
+}
+
+// hashFile reads relPath from fs and returns its hex digest.
+func hashFile(ctx context.Context, fs protocols.FileSystem, relPath, mode string) (string, error) {
+	h, err := newVerifyHash(mode)
+	if err != nil {
+		return "", err
+	}
+	r, err := fs.Open(ctx, relPath)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	if _, err := io.Copy(h, contextReader{ctx, r}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyTarget checks the written file against the size and, for hash modes,
+// the digest of what was read from the source. The target's digest comes
+// from the server when the file system supports it, otherwise the file is
+// read back.
+func verifyTarget(ctx context.Context, dstFS protocols.FileSystem, relPath, mode string, size int64, digest string) error {
+	st, err := dstFS.Stat(ctx, relPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat target: %v", err)
+	}
+	if st.Size != size {
+		return fmt.Errorf("size mismatch: target has %d bytes, source %d", st.Size, size)
+	}
+	if digest == "" {
+		return nil
+	}
+
+	var got string
+	if hasher, ok := dstFS.(protocols.Hasher); ok {
+		got, err = hasher.Hash(ctx, relPath, mode)
+		if err != nil {
+			log.Printf("Server-side %s of %s unavailable, reading back: %v", mode, relPath, err)
+		}
+	}
+	if got == "" {
+		got, err = hashFile(ctx, dstFS, relPath, mode)
+		if err != nil {
+			return fmt.Errorf("failed to hash target: %v", err)
+		}
+	}
+
+	if !strings.EqualFold(got, digest) {
+		return fmt.Errorf("%s mismatch: target %s, source %s", mode, got, digest)
+	}
+	return nil
+}
@@ -2,18 +2,25 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"filetransferhx/config"
 	"filetransferhx/core"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validate(os.Args[2:]))
+	}
+
 	configPath := flag.String("config", "config.toml", "Path to config file")
 	historyPath := flag.String("history", "history.json", "Path to history file")
+	watch := flag.Duration("watch", 0, "Reload the config file when it changes, checking at this interval (e.g. 5s); it is always reloaded on SIGHUP")
 	flag.Parse()
 
 	// 1. Load Config
@@ -37,12 +44,87 @@ func main() {
 
 	log.Println("FileTransferHX started...")
 
-	// 5. Wait for signal
+	// 5. Reload the config on SIGHUP and, with -watch, when it changes
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	changed := make(chan struct{}, 1)
+	if *watch > 0 {
+		go watchConfig(*configPath, *watch, changed)
+	}
+	go func() {
+		for {
+			select {
+			case <-hup:
+				log.Println("Received SIGHUP, reloading config")
+			case <-changed:
+				log.Println("Config file changed, reloading")
+			}
+			reload(runner, *configPath)
+		}
+	}()
+
+	// 6. Wait for signal
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
 
 	log.Println("Shutting down...")
+	go func() {
+		<-sigChan
+		log.Println("Interrupted again, exiting without waiting for transfers")
+		hm.Save()
+		os.Exit(1)
+	}()
 	runner.Stop()
 	hm.Save()
 }
+
+// validate implements "filetransferhx validate -config x.toml": it reports
+// every problem in the config and exits non-zero if there are any.
+func validate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	configPath := flags.String("config", "config.toml", "Path to config file")
+	flags.Parse(args)
+
+	if _, err := config.LoadConfig(*configPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s: OK\n", *configPath)
+	return 0
+}
+
+// reload applies the config file to runner, keeping the running config if
+// the file is invalid.
+func reload(runner *core.Runner, path string) {
+	cfg, err := config.LoadConfig(path)
+	if err == nil {
+		err = runner.Reload(cfg)
+	}
+	if err != nil {
+		log.Printf("Failed to reload config, keeping the current one: %v", err)
+		return
+	}
+	log.Println("Config reloaded")
+}
+
+// watchConfig signals changed whenever the size or modification time of the
+// file at path changes.
+func watchConfig(path string, interval time.Duration, changed chan<- struct{}) {
+	last, _ := os.Stat(path)
+	for range time.Tick(interval) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			// Possibly being replaced by an editor; look again next time
+			continue
+		}
+		if last != nil && fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size() {
+			continue
+		}
+		last = fi
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+}
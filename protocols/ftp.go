@@ -1,8 +1,13 @@
 package protocols
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"net/textproto"
 	"path"
 	"time"
 
@@ -15,12 +20,37 @@ type FTPFileSystem struct {
 	User     string
 	Password string
 	RootPath string
-	conn     *ftp.ServerConn
+	// TLSMode selects FTPS: "" for plain FTP, "explicit" for AUTH TLS,
+	// "implicit" for TLS from the first byte (usually port 990).
+	TLSMode string
+	TLS     TLSOptions
+	conn    *ftp.ServerConn
 }
 
-func (f *FTPFileSystem) Init() error {
+func (f *FTPFileSystem) Init(ctx context.Context) error {
 	addr := fmt.Sprintf("%s:%d", f.Host, f.Port)
-	c, err := ftp.Dial(addr, ftp.DialWithTimeout(30*time.Second))
+	opts := []ftp.DialOption{ftp.DialWithTimeout(30 * time.Second), ftp.DialWithContext(ctx)}
+
+	switch f.TLSMode {
+	case "":
+	case "explicit", "implicit":
+		tlsConfig, err := f.TLS.Config(f.Host)
+		if err != nil {
+			return err
+		}
+		// Many servers require the data connection to resume the control
+		// connection's TLS session.
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+		if f.TLSMode == "explicit" {
+			opts = append(opts, ftp.DialWithExplicitTLS(tlsConfig))
+		} else {
+			opts = append(opts, ftp.DialWithTLS(tlsConfig))
+		}
+	default:
+		return fmt.Errorf("unknown ftps mode: %s", f.TLSMode)
+	}
+
+	c, err := ftp.Dial(addr, opts...)
 	if err != nil {
 		return err
 	}
@@ -40,7 +70,7 @@ func (f *FTPFileSystem) Close() error {
 	return nil
 }
 
-func (f *FTPFileSystem) List(relPath string) ([]FileEntry, error) {
+func (f *FTPFileSystem) List(ctx context.Context, relPath string) ([]FileEntry, error) {
 	fullPath := path.Join(f.RootPath, relPath)
 	entries, err := f.conn.List(fullPath)
 	if err != nil {
@@ -64,35 +94,42 @@ func (f *FTPFileSystem) List(relPath string) ([]FileEntry, error) {
 	return files, nil
 }
 
-func (f *FTPFileSystem) Open(relPath string) (io.ReadCloser, error) {
+func (f *FTPFileSystem) Open(ctx context.Context, relPath string) (io.ReadCloser, error) {
 	fullPath := path.Join(f.RootPath, relPath)
 	return f.conn.Retr(fullPath)
 }
 
-func (f *FTPFileSystem) Create(relPath string) (io.WriteCloser, error) {
+// OpenAt uses REST to start the download at offset.
+func (f *FTPFileSystem) OpenAt(ctx context.Context, relPath string, offset int64) (io.ReadCloser, error) {
+	fullPath := path.Join(f.RootPath, relPath)
+	return f.conn.RetrFrom(fullPath, uint64(offset))
+}
+
+// Append uses APPE to continue an existing file.
+func (f *FTPFileSystem) Append(ctx context.Context, relPath string) (io.WriteCloser, error) {
+	fullPath := path.Join(f.RootPath, relPath)
+	return newPipeWriter(func(r io.Reader) error {
+		return f.conn.Append(fullPath, r)
+	}), nil
+}
+
+func (f *FTPFileSystem) Create(ctx context.Context, relPath string) (io.WriteCloser, error) {
 	fullPath := path.Join(f.RootPath, relPath)
 	// FTP Stor requires a reader, but our interface expects returning a writer.
 	// This is a mismatch. The standard io.Copy works with Reader -> Writer.
 	// If we return a WriteCloser, we need to pipe it.
-	r, w := io.Pipe()
-	go func() {
-		err := f.conn.Stor(fullPath, r)
-		if err != nil {
-			r.CloseWithError(err)
-		} else {
-			r.Close()
-		}
-	}()
-	return w, nil
+	return newPipeWriter(func(r io.Reader) error {
+		return f.conn.Stor(fullPath, r)
+	}), nil
 }
 
-func (f *FTPFileSystem) MkdirAll(relPath string) error {
+func (f *FTPFileSystem) MkdirAll(ctx context.Context, relPath string) error {
 	fullPath := path.Join(f.RootPath, relPath)
 	// FTP doesn't have MkdirAll, need to create recursively manually or try best effort.
 	// For simplicity, let's try to create the directory directly.
 	// If parent doesn't exist, it might fail.
 	// A robust implementation would split path and create one by one.
-	
+
 	// Simple recursive implementation
 	dirs := []string{}
 	curr := fullPath
@@ -100,26 +137,31 @@ func (f *FTPFileSystem) MkdirAll(relPath string) error {
 		dirs = append(dirs, curr)
 		curr = path.Dir(curr)
 	}
-	
+
 	// Iterate in reverse (root to leaf)
 	for i := len(dirs) - 1; i >= 0; i-- {
 		f.conn.MakeDir(dirs[i]) // Ignore error as it might already exist
 	}
-	
+
 	return nil
 }
 
-func (f *FTPFileSystem) Stat(relPath string) (*FileEntry, error) {
+func (f *FTPFileSystem) Stat(ctx context.Context, relPath string) (*FileEntry, error) {
 	fullPath := path.Join(f.RootPath, relPath)
 	// FTP LIST is often the only way to get stat
 	parent := path.Dir(fullPath)
 	name := path.Base(fullPath)
-	
+
 	entries, err := f.conn.List(parent)
 	if err != nil {
+		// The parent directory does not exist either
+		var reply *textproto.Error
+		if errors.As(err, &reply) && reply.Code == ftp.StatusFileUnavailable {
+			return nil, &fs.PathError{Op: "stat", Path: relPath, Err: fs.ErrNotExist}
+		}
 		return nil, err
 	}
-	
+
 	for _, entry := range entries {
 		if entry.Name == name {
 			return &FileEntry{
@@ -131,10 +173,49 @@ func (f *FTPFileSystem) Stat(relPath string) (*FileEntry, error) {
 			}, nil
 		}
 	}
-	return nil, fmt.Errorf("file not found: %s", relPath)
+	return nil, &fs.PathError{Op: "stat", Path: relPath, Err: fs.ErrNotExist}
 }
 
-func (f *FTPFileSystem) Remove(relPath string) error {
+func (f *FTPFileSystem) Remove(ctx context.Context, relPath string) error {
 	fullPath := path.Join(f.RootPath, relPath)
-	return f.conn.Delete(fullPath)
+	err := f.conn.Delete(fullPath)
+	if err != nil && f.conn.RemoveDir(fullPath) == nil {
+		return nil
+	}
+	return err
+}
+
+func (f *FTPFileSystem) Rename(ctx context.Context, oldPath, newPath string) error {
+	oldFull := path.Join(f.RootPath, oldPath)
+	newFull := path.Join(f.RootPath, newPath)
+	err := f.conn.Rename(oldFull, newFull)
+	if err == nil {
+		return nil
+	}
+
+	// Some servers refuse RNTO onto an existing file. Only then is the
+	// target moved aside for a second attempt; any other failure (missing
+	// source, no permission, lost connection) leaves it alone.
+	var reply *textproto.Error
+	if !errors.As(err, &reply) || reply.Code < 500 {
+		return err
+	}
+	if src, statErr := f.Stat(ctx, oldPath); statErr != nil || src.IsDir {
+		return err
+	}
+	if dst, statErr := f.Stat(ctx, newPath); statErr != nil || dst.IsDir {
+		return err
+	}
+	aside := path.Join(path.Dir(newFull), "."+path.Base(newFull)+".replaced")
+	if f.conn.Rename(newFull, aside) != nil {
+		return err
+	}
+	if err := f.conn.Rename(oldFull, newFull); err != nil {
+		if restoreErr := f.conn.Rename(aside, newFull); restoreErr != nil {
+			return fmt.Errorf("%v (previous %s left at %s: %v)", err, newPath, aside, restoreErr)
+		}
+		return err
+	}
+	f.conn.Delete(aside)
+	return nil
 }
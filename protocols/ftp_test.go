@@ -0,0 +1,228 @@
+package protocols
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	iofs "io/fs"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeFTP is an in-process FTP server with a flat set of files, enough for
+// Stat and Rename: login, EPSV, LIST, RNFR/RNTO and DELE.
+type fakeFTP struct {
+	mu    sync.Mutex
+	files map[string]string // full path -> content
+	// noOverwrite refuses RNTO onto an existing file, as some servers do.
+	noOverwrite bool
+	// denyRename refuses RNFR of these paths even though they exist.
+	denyRename map[string]bool
+}
+
+// newFakeFTP serves f and returns a file system logged in to it.
+func newFakeFTP(t *testing.T, f *fakeFTP) *FTPFileSystem {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+
+	addr := l.Addr().(*net.TCPAddr)
+	fs := &FTPFileSystem{Host: "127.0.0.1", Port: addr.Port, User: "u", Password: "p", RootPath: "/"}
+	if err := fs.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fs.Close() })
+	return fs
+}
+
+func (f *fakeFTP) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(format string, args ...any) { fmt.Fprintf(conn, format+"\r\n", args...) }
+	reply("220 fake")
+
+	var data net.Listener
+	var renameFrom string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+
+		f.mu.Lock()
+		switch strings.ToUpper(cmd) {
+		case "USER":
+			reply("331 password")
+		case "PASS":
+			reply("230 logged in")
+		case "TYPE":
+			reply("200 ok")
+		case "EPSV":
+			data, err = net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				reply("425 %v", err)
+				break
+			}
+			reply("229 Entering Extended Passive Mode (|||%d|)", data.Addr().(*net.TCPAddr).Port)
+		case "LIST":
+			if data == nil {
+				reply("425 no data connection")
+				break
+			}
+			if !f.isDir(arg) {
+				data.Close()
+				data = nil
+				reply("550 %s: no such directory", arg)
+				break
+			}
+			reply("150 listing")
+			if dc, err := data.Accept(); err == nil {
+				for name, content := range f.files {
+					if path.Dir(name) == path.Clean(arg) {
+						fmt.Fprintf(dc, "-rw-r--r-- 1 u g %d Jan 31 12:00 %s\r\n", len(content), path.Base(name))
+					}
+				}
+				dc.Close()
+			}
+			data.Close()
+			data = nil
+			reply("226 done")
+		case "RNFR":
+			if _, ok := f.files[arg]; !ok || f.denyRename[arg] {
+				reply("550 %s: cannot rename", arg)
+				break
+			}
+			renameFrom = arg
+			reply("350 ready")
+		case "RNTO":
+			if _, ok := f.files[arg]; ok && f.noOverwrite {
+				reply("553 %s: file exists", arg)
+				break
+			}
+			f.files[arg] = f.files[renameFrom]
+			delete(f.files, renameFrom)
+			reply("250 renamed")
+		case "DELE":
+			if _, ok := f.files[arg]; !ok {
+				reply("550 %s: not found", arg)
+				break
+			}
+			delete(f.files, arg)
+			reply("250 deleted")
+		case "QUIT":
+			reply("221 bye")
+			f.mu.Unlock()
+			return
+		default:
+			reply("502 %s not implemented", cmd)
+		}
+		f.mu.Unlock()
+	}
+}
+
+// isDir reports whether some file lives under dir. The caller holds f.mu.
+func (f *fakeFTP) isDir(dir string) bool {
+	prefix := strings.TrimSuffix(path.Clean(dir), "/") + "/"
+	for name := range f.files {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeFTP) snapshot() map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	files := make(map[string]string)
+	for k, v := range f.files {
+		files[k] = v
+	}
+	return files
+}
+
+func TestFTPRename(t *testing.T) {
+	tests := []struct {
+		name        string
+		files       map[string]string
+		noOverwrite bool
+		denyRename  string
+		wantErr     bool
+		want        map[string]string
+	}{
+		{
+			name:  "plain rename",
+			files: map[string]string{"/d/a.part": "new"},
+			want:  map[string]string{"/d/a": "new"},
+		},
+		{
+			name:  "overwrite allowed",
+			files: map[string]string{"/d/a.part": "new", "/d/a": "old"},
+			want:  map[string]string{"/d/a": "new"},
+		},
+		{
+			name:        "overwrite refused",
+			files:       map[string]string{"/d/a.part": "new", "/d/a": "old"},
+			noOverwrite: true,
+			want:        map[string]string{"/d/a": "new"},
+		},
+		{
+			name:        "source missing",
+			files:       map[string]string{"/d/a": "old"},
+			noOverwrite: true,
+			wantErr:     true,
+			want:        map[string]string{"/d/a": "old"},
+		},
+		{
+			name:        "source not renamable",
+			files:       map[string]string{"/d/a.part": "new", "/d/a": "old"},
+			noOverwrite: true,
+			denyRename:  "/d/a.part",
+			wantErr:     true,
+			want:        map[string]string{"/d/a.part": "new", "/d/a": "old"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeFTP{files: tt.files, noOverwrite: tt.noOverwrite, denyRename: map[string]bool{tt.denyRename: true}}
+			fs := newFakeFTP(t, fake)
+			err := fs.Rename(context.Background(), "d/a.part", "d/a")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Rename: %v, want error %v", err, tt.wantErr)
+			}
+			if got := fake.snapshot(); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("files %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFTPStat(t *testing.T) {
+	fs := newFakeFTP(t, &fakeFTP{files: map[string]string{"/d/a": "12345"}})
+	st, err := fs.Stat(context.Background(), "d/a")
+	if err != nil || st.Size != 5 || st.IsDir {
+		t.Errorf("Stat(d/a) = %+v, %v", st, err)
+	}
+	for _, missing := range []string{"d/b", "e/a"} {
+		if _, err := fs.Stat(context.Background(), missing); !errors.Is(err, iofs.ErrNotExist) {
+			t.Errorf("Stat(%s): %v, want fs.ErrNotExist", missing, err)
+		}
+	}
+}
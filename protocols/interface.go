@@ -1,6 +1,7 @@
 package protocols
 
 import (
+	"context"
 	"io"
 	"time"
 )
@@ -13,14 +14,43 @@ type FileEntry struct {
 	Path    string // 相对路径
 }
 
+// FileSystem is a connection to one storage location. ctx cancels an
+// operation as far as the underlying client allows; for Init it only bounds
+// connecting, not the lifetime of the connection. Streams returned by Open
+// and Create may not observe ctx once they are open, so callers stop
+// copying themselves.
 type FileSystem interface {
-	Init() error
+	Init(ctx context.Context) error
 	Close() error
 	// List returns a list of files in the specified directory (non-recursive).
-	List(path string) ([]FileEntry, error)
-	Open(path string) (io.ReadCloser, error)
-	Create(path string) (io.WriteCloser, error)
-	MkdirAll(path string) error
-	Stat(path string) (*FileEntry, error)
-	Remove(path string) error
+	List(ctx context.Context, path string) ([]FileEntry, error)
+	Open(ctx context.Context, path string) (io.ReadCloser, error)
+	Create(ctx context.Context, path string) (io.WriteCloser, error)
+	MkdirAll(ctx context.Context, path string) error
+	// Stat returns an error wrapping fs.ErrNotExist if path does not exist,
+	// so callers can tell that apart from failing to find out.
+	Stat(ctx context.Context, path string) (*FileEntry, error)
+	// Remove deletes a file or an empty directory.
+	Remove(ctx context.Context, path string) error
+	// Rename moves oldPath to newPath, replacing newPath if it exists.
+	Rename(ctx context.Context, oldPath, newPath string) error
+}
+
+// RangeReader is implemented by file systems that can start reading a file
+// at an offset without transferring the bytes before it.
+type RangeReader interface {
+	OpenAt(ctx context.Context, path string, offset int64) (io.ReadCloser, error)
+}
+
+// Hasher is implemented by file systems that can compute a file's digest on
+// the server, which saves downloading the file again to verify it.
+// algorithm is "md5" or "sha256"; the result is lowercase hex.
+type Hasher interface {
+	Hash(ctx context.Context, path, algorithm string) (string, error)
+}
+
+// Appender is implemented by file systems that can continue writing at the
+// end of an existing file.
+type Appender interface {
+	Append(ctx context.Context, path string) (io.WriteCloser, error)
 }
@@ -1,6 +1,7 @@
 package protocols
 
 import (
+	"context"
 	"io"
 	"os"
 	"path/filepath"
@@ -11,7 +12,7 @@ type LocalFileSystem struct {
 	RootPath string
 }
 
-func (l *LocalFileSystem) Init() error {
+func (l *LocalFileSystem) Init(ctx context.Context) error {
 	return os.MkdirAll(l.RootPath, 0755)
 }
 
@@ -19,7 +20,7 @@ func (l *LocalFileSystem) Close() error {
 	return nil
 }
 
-func (l *LocalFileSystem) List(path string) ([]FileEntry, error) {
+func (l *LocalFileSystem) List(ctx context.Context, path string) ([]FileEntry, error) {
 	fullPath := filepath.Join(l.RootPath, path)
 	entries, err := os.ReadDir(fullPath)
 	if err != nil {
@@ -43,21 +44,37 @@ func (l *LocalFileSystem) List(path string) ([]FileEntry, error) {
 	return files, nil
 }
 
-func (l *LocalFileSystem) Open(path string) (io.ReadCloser, error) {
+func (l *LocalFileSystem) Open(ctx context.Context, path string) (io.ReadCloser, error) {
 	return os.Open(filepath.Join(l.RootPath, path))
 }
 
-func (l *LocalFileSystem) Create(path string) (io.WriteCloser, error) {
+func (l *LocalFileSystem) OpenAt(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(l.RootPath, path))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (l *LocalFileSystem) Append(ctx context.Context, path string) (io.WriteCloser, error) {
+	return os.OpenFile(filepath.Join(l.RootPath, path), os.O_WRONLY|os.O_APPEND, 0)
+}
+
+func (l *LocalFileSystem) Create(ctx context.Context, path string) (io.WriteCloser, error) {
 	fullPath := filepath.Join(l.RootPath, path)
 	return os.Create(fullPath)
 }
 
-func (l *LocalFileSystem) MkdirAll(path string) error {
+func (l *LocalFileSystem) MkdirAll(ctx context.Context, path string) error {
 	fullPath := filepath.Join(l.RootPath, path)
 	return os.MkdirAll(fullPath, 0755)
 }
 
-func (l *LocalFileSystem) Stat(path string) (*FileEntry, error) {
+func (l *LocalFileSystem) Stat(ctx context.Context, path string) (*FileEntry, error) {
 	fullPath := filepath.Join(l.RootPath, path)
 	info, err := os.Stat(fullPath)
 	if err != nil {
@@ -72,7 +89,11 @@ func (l *LocalFileSystem) Stat(path string) (*FileEntry, error) {
 	}, nil
 }
 
-func (l *LocalFileSystem) Remove(path string) error {
+func (l *LocalFileSystem) Remove(ctx context.Context, path string) error {
 	fullPath := filepath.Join(l.RootPath, path)
 	return os.Remove(fullPath)
 }
+
+func (l *LocalFileSystem) Rename(ctx context.Context, oldPath, newPath string) error {
+	return os.Rename(filepath.Join(l.RootPath, oldPath), filepath.Join(l.RootPath, newPath))
+}
@@ -0,0 +1,50 @@
+package protocols
+
+import "io"
+
+// pipeWriter adapts APIs that consume an io.Reader (FTP STOR, S3 PutObject,
+// HTTP PUT) to the io.WriteCloser returned by FileSystem.Create.
+//
+// Close waits for the consumer to finish and returns its error, so a caller
+// that checks Close knows whether the upload actually succeeded.
+type pipeWriter struct {
+	w      *io.PipeWriter
+	done   chan error
+	closed bool
+	err    error
+}
+
+func newPipeWriter(consume func(r io.Reader) error) *pipeWriter {
+	r, w := io.Pipe()
+	pw := &pipeWriter{w: w, done: make(chan error, 1)}
+	go func() {
+		err := consume(r)
+		if err != nil {
+			r.CloseWithError(err)
+		} else {
+			r.Close()
+		}
+		pw.done <- err
+	}()
+	return pw
+}
+
+func (p *pipeWriter) Write(b []byte) (int, error) {
+	return p.w.Write(b)
+}
+
+func (p *pipeWriter) Close() error {
+	return p.CloseWithError(nil)
+}
+
+// CloseWithError makes the consumer see err instead of EOF, so a failed
+// copy aborts the upload rather than committing a truncated file.
+func (p *pipeWriter) CloseWithError(err error) error {
+	if p.closed {
+		return p.err
+	}
+	p.closed = true
+	p.w.CloseWithError(err)
+	p.err = <-p.done
+	return p.err
+}
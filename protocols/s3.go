@@ -0,0 +1,220 @@
+package protocols
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3PartSize is the multipart chunk size used by Create. Uploads of unknown
+// length are limited to 10000 parts, so this allows objects up to ~160GB.
+const s3PartSize = 16 << 20
+
+// S3FileSystem maps the FileSystem interface onto an S3-compatible bucket.
+// Directories are key prefixes separated by "/", so MkdirAll is a no-op.
+type S3FileSystem struct {
+	Endpoint  string // e.g. https://minio.local:9000
+	Region    string
+	Bucket    string
+	Prefix    string // key prefix inside the bucket
+	AccessKey string
+	SecretKey string
+	PathStyle bool
+	TLS       TLSOptions
+	client    *minio.Client
+}
+
+func (s *S3FileSystem) Init(ctx context.Context) error {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil || u.Host == "" {
+		// Bare host[:port] without a scheme
+		u, err = url.Parse("https://" + s.Endpoint)
+		if err != nil {
+			return fmt.Errorf("invalid s3 endpoint %q: %v", s.Endpoint, err)
+		}
+	}
+	secure := u.Scheme == "https"
+
+	transport, err := minio.DefaultTransport(secure)
+	if err != nil {
+		return err
+	}
+	if secure {
+		tlsConfig, err := s.TLS.Config(u.Hostname())
+		if err != nil {
+			return err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	lookup := minio.BucketLookupAuto
+	if s.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds:        credentials.NewStaticV4(s.AccessKey, s.SecretKey, ""),
+		Secure:       secure,
+		Transport:    transport,
+		Region:       s.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return err
+	}
+
+	exists, err := client.BucketExists(ctx, s.Bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("bucket not found: %s", s.Bucket)
+	}
+	s.client = client
+	return nil
+}
+
+func (s *S3FileSystem) Close() error {
+	return nil
+}
+
+func (s *S3FileSystem) key(relPath string) string {
+	return strings.TrimPrefix(path.Join(s.Prefix, relPath), "/")
+}
+
+func (s *S3FileSystem) dirPrefix(relPath string) string {
+	k := s.key(relPath)
+	if k == "" || k == "." {
+		return ""
+	}
+	return k + "/"
+}
+
+func (s *S3FileSystem) List(ctx context.Context, relPath string) ([]FileEntry, error) {
+	prefix := s.dirPrefix(relPath)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var files []FileEntry
+	for obj := range s.client.ListObjects(ctx, s.Bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		name := strings.TrimPrefix(obj.Key, prefix)
+		isDir := strings.HasSuffix(name, "/")
+		name = strings.TrimSuffix(name, "/")
+		if name == "" {
+			// Directory marker object for the prefix itself
+			continue
+		}
+		files = append(files, FileEntry{
+			Name:    name,
+			Size:    obj.Size,
+			ModTime: obj.LastModified,
+			IsDir:   isDir,
+			Path:    path.Join(relPath, name),
+		})
+	}
+	return files, nil
+}
+
+func (s *S3FileSystem) Open(ctx context.Context, relPath string) (io.ReadCloser, error) {
+	obj, err := s.client.GetObject(ctx, s.Bucket, s.key(relPath), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy; Stat surfaces a missing key here instead of on first Read.
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (s *S3FileSystem) OpenAt(ctx context.Context, relPath string, offset int64) (io.ReadCloser, error) {
+	obj, err := s.client.GetObject(ctx, s.Bucket, s.key(relPath), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// Stat drops a Range set in the options, so seek instead; the first
+	// Read then requests the object from offset.
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, err
+	}
+	if _, err := obj.Seek(offset, io.SeekStart); err != nil {
+		obj.Close()
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (s *S3FileSystem) Create(ctx context.Context, relPath string) (io.WriteCloser, error) {
+	key := s.key(relPath)
+	// Unknown size makes PutObject stream a multipart upload.
+	return newPipeWriter(func(r io.Reader) error {
+		_, err := s.client.PutObject(ctx, s.Bucket, key, r, -1, minio.PutObjectOptions{
+			PartSize: s3PartSize,
+		})
+		return err
+	}), nil
+}
+
+func (s *S3FileSystem) MkdirAll(ctx context.Context, relPath string) error {
+	return nil
+}
+
+func (s *S3FileSystem) Stat(ctx context.Context, relPath string) (*FileEntry, error) {
+	info, err := s.client.StatObject(ctx, s.Bucket, s.key(relPath), minio.StatObjectOptions{})
+	if err == nil {
+		return &FileEntry{
+			Name:    path.Base(relPath),
+			Size:    info.Size,
+			ModTime: info.LastModified,
+			IsDir:   false,
+			Path:    relPath,
+		}, nil
+	}
+	if minio.ToErrorResponse(err).Code != minio.NoSuchKey {
+		return nil, err
+	}
+
+	// No object with that key; it may still be a prefix ("directory").
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for obj := range s.client.ListObjects(ctx, s.Bucket, minio.ListObjectsOptions{Prefix: s.dirPrefix(relPath), MaxKeys: 1}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		return &FileEntry{
+			Name:  path.Base(relPath),
+			IsDir: true,
+			Path:  relPath,
+		}, nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: relPath, Err: fs.ErrNotExist}
+}
+
+func (s *S3FileSystem) Remove(ctx context.Context, relPath string) error {
+	return s.client.RemoveObject(ctx, s.Bucket, s.key(relPath), minio.RemoveObjectOptions{})
+}
+
+// Rename is a server-side copy followed by a delete; S3 has no rename.
+func (s *S3FileSystem) Rename(ctx context.Context, oldPath, newPath string) error {
+	_, err := s.client.ComposeObject(ctx,
+		minio.CopyDestOptions{Bucket: s.Bucket, Object: s.key(newPath)},
+		minio.CopySrcOptions{Bucket: s.Bucket, Object: s.key(oldPath)},
+	)
+	if err != nil {
+		return err
+	}
+	return s.Remove(ctx, oldPath)
+}
@@ -0,0 +1,383 @@
+package protocols
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-process S3 server covering what S3FileSystem uses:
+// bucket HEAD, ListObjectsV2 with a delimiter, ranged GET, HEAD, multipart
+// upload, copy and delete. Requests are not authenticated.
+type fakeS3 struct {
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	uploads map[string]map[int][]byte // upload ID -> parts
+	nextID  int
+}
+
+type fakeObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newFakeS3(t *testing.T, bucket string) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{bucket: bucket, objects: make(map[string]fakeObject), uploads: make(map[string]map[int][]byte)}
+	srv := httptest.NewTLSServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		s3Error(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	q := r.URL.Query()
+
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, q.Get("prefix"), q.Get("delimiter"))
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = make(map[int][]byte)
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: id})
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		parts, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			s3Error(w, r, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			obj, ok := f.source(src)
+			if !ok {
+				s3Error(w, r, http.StatusNotFound, "NoSuchKey")
+				return
+			}
+			var start, end int
+			fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &start, &end)
+			parts[n] = obj.data[start : end+1]
+			writeXML(w, struct {
+				XMLName      xml.Name `xml:"CopyPartResult"`
+				ETag         string
+				LastModified string
+			}{ETag: fmt.Sprintf(`"part%d"`, n), LastModified: obj.modTime.UTC().Format(time.RFC3339)})
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		parts[n] = data
+		w.Header().Set("ETag", fmt.Sprintf(`"part%d"`, n))
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		parts, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			s3Error(w, r, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var data []byte
+		for i := 1; i <= len(parts); i++ {
+			data = append(data, parts[i]...)
+		}
+		delete(f.uploads, q.Get("uploadId"))
+		f.objects[key] = fakeObject{data: data, modTime: time.Now()}
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: `"done"`})
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		delete(f.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		obj, ok := f.source(r.Header.Get("X-Amz-Copy-Source"))
+		if !ok {
+			s3Error(w, r, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		obj.modTime = time.Now()
+		f.objects[key] = obj
+		writeXML(w, struct {
+			XMLName      xml.Name `xml:"CopyObjectResult"`
+			ETag         string
+			LastModified string
+		}{ETag: `"copy"`, LastModified: obj.modTime.UTC().Format(time.RFC3339)})
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		f.get(w, r, key)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, r, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// source returns the object named by an X-Amz-Copy-Source header.
+func (f *fakeS3) source(header string) (fakeObject, bool) {
+	src, _ := url.PathUnescape(header)
+	_, key, _ := strings.Cut(strings.TrimPrefix(src, "/"), "/")
+	obj, ok := f.objects[key]
+	return obj, ok
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix, delimiter string) {
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+	}
+	type commonPrefix struct{ Prefix string }
+	var result struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Name           string
+		Prefix         string
+		Delimiter      string
+		KeyCount       int
+		MaxKeys        int
+		IsTruncated    bool
+		Contents       []content
+		CommonPrefixes []commonPrefix
+	}
+	result.Name, result.Prefix, result.Delimiter, result.MaxKeys = f.bucket, prefix, delimiter, 1000
+
+	var keys []string
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		rest, ok := strings.CutPrefix(k, prefix)
+		if !ok {
+			continue
+		}
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			p := prefix + rest[:i+len(delimiter)]
+			if !seen[p] {
+				seen[p] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{p})
+			}
+			continue
+		}
+		obj := f.objects[k]
+		result.Contents = append(result.Contents, content{
+			Key:          k,
+			LastModified: obj.modTime.UTC().Format(time.RFC3339),
+			ETag:         `"etag"`,
+			Size:         len(obj.data),
+		})
+	}
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+	writeXML(w, result)
+}
+
+func (f *fakeS3) get(w http.ResponseWriter, r *http.Request, key string) {
+	obj, ok := f.objects[key]
+	if !ok {
+		s3Error(w, r, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	data := obj.data
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		var start int
+		if _, err := fmt.Sscanf(rng, "bytes=%d-", &start); err != nil || start >= len(data) {
+			s3Error(w, r, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(data)-1, len(data)))
+		data = data[start:]
+		status = http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Last-Modified", obj.modTime.UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", `"etag"`)
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(data)
+	}
+}
+
+func s3Error(w http.ResponseWriter, r *http.Request, status int, code string) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: code})
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+func newTestS3(t *testing.T, prefix string) (*S3FileSystem, *fakeS3) {
+	t.Helper()
+	fake, srv := newFakeS3(t, "bucket")
+	fs := &S3FileSystem{
+		Endpoint:  srv.URL,
+		Region:    "us-east-1",
+		Bucket:    "bucket",
+		Prefix:    prefix,
+		AccessKey: "key",
+		SecretKey: "secret",
+		PathStyle: true,
+		TLS:       TLSOptions{InsecureSkipVerify: true},
+	}
+	if err := fs.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return fs, fake
+}
+
+func writeS3(t *testing.T, fs *S3FileSystem, relPath, content string) {
+	t.Helper()
+	w, err := fs.Create(context.Background(), relPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, content); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readS3(t *testing.T, fs *S3FileSystem, relPath string, offset int64) string {
+	t.Helper()
+	var r io.ReadCloser
+	var err error
+	if offset == 0 {
+		r, err = fs.Open(context.Background(), relPath)
+	} else {
+		r, err = fs.OpenAt(context.Background(), relPath, offset)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestS3Init(t *testing.T) {
+	_, srv := newFakeS3(t, "bucket")
+	fs := &S3FileSystem{Endpoint: srv.URL, Region: "us-east-1", Bucket: "other", PathStyle: true, TLS: TLSOptions{InsecureSkipVerify: true}}
+	if err := fs.Init(context.Background()); err == nil {
+		t.Error("missing bucket: no error")
+	}
+}
+
+func TestS3FileSystem(t *testing.T) {
+	ctx := context.Background()
+	fs, fake := newTestS3(t, "root")
+
+	writeS3(t, fs, "a.txt", "hello world")
+	writeS3(t, fs, "dir/b.txt", "bee")
+	writeS3(t, fs, "dir/sub/c.txt", "sea")
+	if _, ok := fake.objects["root/a.txt"]; !ok {
+		t.Fatalf("objects %v, want keys under the prefix", fake.objects)
+	}
+
+	entries, err := fs.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]FileEntry)
+	for _, e := range entries {
+		got[e.Path] = e
+	}
+	if len(got) != 2 || got["a.txt"].Size != 11 || got["a.txt"].IsDir || !got["dir"].IsDir {
+		t.Errorf("List(\"\") = %+v", entries)
+	}
+	if entries, err := fs.List(ctx, "dir"); err != nil || len(entries) != 2 {
+		t.Errorf("List(dir) = %+v, %v", entries, err)
+	}
+
+	if s := readS3(t, fs, "a.txt", 0); s != "hello world" {
+		t.Errorf("Open = %q", s)
+	}
+	if s := readS3(t, fs, "a.txt", 6); s != "world" {
+		t.Errorf("OpenAt(6) = %q", s)
+	}
+	if _, err := fs.Open(ctx, "missing.txt"); err == nil {
+		t.Error("Open of a missing key: no error")
+	}
+
+	if st, err := fs.Stat(ctx, "dir/b.txt"); err != nil || st.Size != 3 || st.IsDir {
+		t.Errorf("Stat(file) = %+v, %v", st, err)
+	}
+	if st, err := fs.Stat(ctx, "dir/sub"); err != nil || !st.IsDir {
+		t.Errorf("Stat(prefix) = %+v, %v", st, err)
+	}
+	if _, err := fs.Stat(ctx, "nothing"); !errors.Is(err, iofs.ErrNotExist) {
+		t.Errorf("Stat of nothing: %v, want fs.ErrNotExist", err)
+	}
+
+	if err := fs.Rename(ctx, "a.txt", "moved/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(ctx, "a.txt"); err == nil {
+		t.Error("renamed object still exists")
+	}
+	if s := readS3(t, fs, "moved/a.txt", 0); s != "hello world" {
+		t.Errorf("renamed object = %q", s)
+	}
+
+	if err := fs.Remove(ctx, "dir/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(ctx, "dir/b.txt"); err == nil {
+		t.Error("removed object still exists")
+	}
+}
+
+func TestS3CreateAbort(t *testing.T) {
+	fs, fake := newTestS3(t, "")
+	w, err := fs.Create(context.Background(), "partial.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "half")
+	w.(interface{ CloseWithError(error) error }).CloseWithError(fmt.Errorf("source failed"))
+	if _, ok := fake.objects["partial.txt"]; ok {
+		t.Error("aborted upload was committed")
+	}
+}
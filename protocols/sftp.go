@@ -1,9 +1,13 @@
 package protocols
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"net"
+	"os"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/pkg/sftp"
@@ -16,23 +20,51 @@ type SFTPFileSystem struct {
 	User     string
 	Password string
 	RootPath string
-	client   *sftp.Client
-	sshConn  *ssh.Client
+	// PrivateKey is the path to a PEM or OpenSSH private key file.
+	PrivateKey string
+	Passphrase string
+	UseAgent   bool
+	// AuthMethods overrides DefaultSSHAuthOrder.
+	AuthMethods []string
+	// HostKeyCheck is "tofu" (default), "strict" or "none"; see hostKeyCallback.
+	HostKeyCheck        string
+	KnownHosts          string
+	HostKeyFingerprints []string
+	client              *sftp.Client
+	sshConn             *ssh.Client
+	agentConn           net.Conn
 }
 
-func (s *SFTPFileSystem) Init() error {
-	config := &ssh.ClientConfig{
-		User: s.User,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(s.Password),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         30 * time.Second,
+func (s *SFTPFileSystem) Init(ctx context.Context) error {
+	hostKeyCallback, err := s.hostKeyCallback()
+	if err != nil {
+		return err
+	}
+
+	auth, err := s.authMethods()
+	if err != nil {
+		s.closeAgent()
+		return err
 	}
 
 	addr := fmt.Sprintf("%s:%d", s.Host, s.Port)
-	conn, err := ssh.Dial("tcp", addr, config)
+	hostKeyAlgorithms, err := s.hostKeyAlgorithms(addr)
+	if err != nil {
+		s.closeAgent()
+		return err
+	}
+
+	config := &ssh.ClientConfig{
+		User:              s.User,
+		Auth:              auth,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgorithms,
+		Timeout:           30 * time.Second,
+	}
+
+	conn, err := dialSSH(ctx, addr, config)
 	if err != nil {
+		s.closeAgent()
 		return err
 	}
 	s.sshConn = conn
@@ -40,12 +72,35 @@ func (s *SFTPFileSystem) Init() error {
 	client, err := sftp.NewClient(conn)
 	if err != nil {
 		conn.Close()
+		s.closeAgent()
 		return err
 	}
 	s.client = client
 	return nil
 }
 
+// dialSSH is ssh.Dial, except that ctx can abort the connect and the
+// handshake.
+func dialSSH(ctx context.Context, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	dialer := net.Dialer{Timeout: config.Timeout}
+	nc, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { nc.Close() })
+	c, chans, reqs, err := ssh.NewClientConn(nc, addr, config)
+	if !stop() {
+		if err == nil {
+			c.Close()
+		}
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
 func (s *SFTPFileSystem) Close() error {
 	if s.client != nil {
 		s.client.Close()
@@ -53,10 +108,18 @@ func (s *SFTPFileSystem) Close() error {
 	if s.sshConn != nil {
 		s.sshConn.Close()
 	}
+	s.closeAgent()
 	return nil
 }
 
-func (s *SFTPFileSystem) List(relPath string) ([]FileEntry, error) {
+func (s *SFTPFileSystem) closeAgent() {
+	if s.agentConn != nil {
+		s.agentConn.Close()
+		s.agentConn = nil
+	}
+}
+
+func (s *SFTPFileSystem) List(ctx context.Context, relPath string) ([]FileEntry, error) {
 	fullPath := path.Join(s.RootPath, relPath)
 	entries, err := s.client.ReadDir(fullPath)
 	if err != nil {
@@ -76,22 +139,47 @@ func (s *SFTPFileSystem) List(relPath string) ([]FileEntry, error) {
 	return files, nil
 }
 
-func (s *SFTPFileSystem) Open(relPath string) (io.ReadCloser, error) {
+func (s *SFTPFileSystem) Open(ctx context.Context, relPath string) (io.ReadCloser, error) {
 	fullPath := path.Join(s.RootPath, relPath)
 	return s.client.Open(fullPath)
 }
 
-func (s *SFTPFileSystem) Create(relPath string) (io.WriteCloser, error) {
+func (s *SFTPFileSystem) OpenAt(ctx context.Context, relPath string, offset int64) (io.ReadCloser, error) {
+	f, err := s.client.Open(path.Join(s.RootPath, relPath))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *SFTPFileSystem) Append(ctx context.Context, relPath string) (io.WriteCloser, error) {
+	// Not every server honours SSH_FXF_APPEND, so position explicitly.
+	f, err := s.client.OpenFile(path.Join(s.RootPath, relPath), os.O_WRONLY)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *SFTPFileSystem) Create(ctx context.Context, relPath string) (io.WriteCloser, error) {
 	fullPath := path.Join(s.RootPath, relPath)
 	return s.client.Create(fullPath)
 }
 
-func (s *SFTPFileSystem) MkdirAll(relPath string) error {
+func (s *SFTPFileSystem) MkdirAll(ctx context.Context, relPath string) error {
 	fullPath := path.Join(s.RootPath, relPath)
 	return s.client.MkdirAll(fullPath)
 }
 
-func (s *SFTPFileSystem) Stat(relPath string) (*FileEntry, error) {
+func (s *SFTPFileSystem) Stat(ctx context.Context, relPath string) (*FileEntry, error) {
 	fullPath := path.Join(s.RootPath, relPath)
 	info, err := s.client.Stat(fullPath)
 	if err != nil {
@@ -106,7 +194,57 @@ func (s *SFTPFileSystem) Stat(relPath string) (*FileEntry, error) {
 	}, nil
 }
 
-func (s *SFTPFileSystem) Remove(relPath string) error {
+func (s *SFTPFileSystem) Remove(ctx context.Context, relPath string) error {
 	fullPath := path.Join(s.RootPath, relPath)
 	return s.client.Remove(fullPath)
 }
+
+// Hash runs md5sum/sha256sum on the server over an exec channel. Servers that
+// only allow the sftp subsystem reject this and callers fall back to
+// reading the file back.
+func (s *SFTPFileSystem) Hash(ctx context.Context, relPath, algorithm string) (string, error) {
+	var cmd string
+	switch algorithm {
+	case "md5":
+		cmd = "md5sum"
+	case "sha256":
+		cmd = "sha256sum"
+	default:
+		return "", fmt.Errorf("unsupported hash algorithm: %s", algorithm)
+	}
+
+	session, err := s.sshConn.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	stop := context.AfterFunc(ctx, func() { session.Close() })
+	defer stop()
+
+	fullPath := path.Join(s.RootPath, relPath)
+	quoted := "'" + strings.ReplaceAll(fullPath, "'", `'\''`) + "'"
+	out, err := session.Output(cmd + " -- " + quoted)
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %v", cmd, err)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("%s returned no output", cmd)
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+func (s *SFTPFileSystem) Rename(ctx context.Context, oldPath, newPath string) error {
+	oldFull := path.Join(s.RootPath, oldPath)
+	newFull := path.Join(s.RootPath, newPath)
+	// Plain SFTP rename refuses to overwrite; the OpenSSH extension replaces atomically.
+	if _, ok := s.client.HasExtension("posix-rename@openssh.com"); ok {
+		return s.client.PosixRename(oldFull, newFull)
+	}
+	if _, err := s.client.Stat(newFull); err == nil {
+		if err := s.client.Remove(newFull); err != nil {
+			return err
+		}
+	}
+	return s.client.Rename(oldFull, newFull)
+}
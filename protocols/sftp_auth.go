@@ -0,0 +1,118 @@
+package protocols
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// DefaultSSHAuthOrder is the order authentication methods are offered in
+// when SFTPFileSystem.AuthMethods is empty. Methods without the required
+// settings (no key file, no agent socket, no password) are left out.
+var DefaultSSHAuthOrder = []string{"publickey", "agent", "keyboard-interactive", "password"}
+
+// authMethods builds the ssh.AuthMethod list in the configured order.
+//
+// The ssh client only tries each method name once, so the key file and the
+// agent are merged into a single "publickey" method placed where the first of
+// them appears, offering key file signers before agent signers.
+func (s *SFTPFileSystem) authMethods() ([]ssh.AuthMethod, error) {
+	order := s.AuthMethods
+	if len(order) == 0 {
+		order = DefaultSSHAuthOrder
+	}
+
+	var methods []ssh.AuthMethod
+	var signers []ssh.Signer
+	publicKeyAdded := false
+
+	for _, name := range order {
+		switch name {
+		case "publickey", "agent":
+			if name == "publickey" {
+				if s.PrivateKey == "" {
+					continue
+				}
+				signer, err := loadPrivateKey(s.PrivateKey, s.Passphrase)
+				if err != nil {
+					return nil, err
+				}
+				signers = append(signers, signer)
+			} else {
+				if !s.UseAgent {
+					continue
+				}
+				agentSigners, err := s.agentSigners()
+				if err != nil {
+					return nil, err
+				}
+				signers = append(signers, agentSigners...)
+			}
+			if !publicKeyAdded {
+				publicKeyAdded = true
+				methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+					return signers, nil
+				}))
+			}
+		case "keyboard-interactive":
+			if s.Password == "" {
+				continue
+			}
+			password := s.Password
+			methods = append(methods, ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range questions {
+					answers[i] = password
+				}
+				return answers, nil
+			}))
+		case "password":
+			if s.Password == "" {
+				continue
+			}
+			methods = append(methods, ssh.Password(s.Password))
+		default:
+			return nil, fmt.Errorf("unknown ssh auth method: %s", name)
+		}
+	}
+
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("no ssh auth method configured")
+	}
+	return methods, nil
+}
+
+func loadPrivateKey(keyPath, passphrase string) (ssh.Signer, error) {
+	pem, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %v", err)
+	}
+	if passphrase != "" {
+		signer, err := ssh.ParsePrivateKeyWithPassphrase(pem, []byte(passphrase))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key %s: %v", keyPath, err)
+		}
+		return signer, nil
+	}
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key %s: %v", keyPath, err)
+	}
+	return signer, nil
+}
+
+func (s *SFTPFileSystem) agentSigners() ([]ssh.Signer, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, fmt.Errorf("ssh agent requested but SSH_AUTH_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ssh agent: %v", err)
+	}
+	s.agentConn = conn
+	return agent.NewClient(conn).Signers()
+}
@@ -0,0 +1,196 @@
+package protocols
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// DefaultTrustedHostsFile is where trust-on-first-use records host keys when
+// SFTPFileSystem.KnownHosts is empty.
+const DefaultTrustedHostsFile = "known_hosts"
+
+// probeHostKey is a key no host has. Checking it against known_hosts yields
+// the keys recorded for a host.
+var probeHostKey, _ = ssh.NewPublicKey(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)).Public())
+
+// tofuMu serialises reads and appends of trust-on-first-use stores, since
+// several tasks may connect to new hosts at the same time.
+var tofuMu sync.Mutex
+
+// hostKeyCallback returns the host key check for the configured policy.
+//
+// Pinned fingerprints take precedence over everything else. Otherwise
+// HostKeyCheck selects "tofu" (default), "strict" (known_hosts only) or
+// "none".
+func (s *SFTPFileSystem) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	if len(s.HostKeyFingerprints) > 0 {
+		return pinnedHostKey(s.HostKeyFingerprints), nil
+	}
+
+	switch s.HostKeyCheck {
+	case "", "tofu":
+		store := s.KnownHosts
+		if store == "" {
+			store = DefaultTrustedHostsFile
+		}
+		return tofuHostKey(store), nil
+	case "strict":
+		if s.KnownHosts == "" {
+			return nil, fmt.Errorf("host_key_check strict requires known_hosts")
+		}
+		cb, err := knownhosts.New(s.KnownHosts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load known_hosts: %v", err)
+		}
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return describeHostKeyError(hostname, key, cb(hostname, remote, key))
+		}, nil
+	case "none":
+		return ssh.InsecureIgnoreHostKey(), nil
+	default:
+		return nil, fmt.Errorf("unknown host key check: %s", s.HostKeyCheck)
+	}
+}
+
+// hostKeyAlgorithms returns the host key algorithms to ask addr for: those of
+// the keys known_hosts records for it. Otherwise the server presents the type
+// the client prefers (ECDSA before ed25519 and RSA), which is reported as a
+// mismatch when only another type is on record. It returns nil, keeping the
+// defaults, when nothing is recorded or the policy does not use known_hosts.
+func (s *SFTPFileSystem) hostKeyAlgorithms(addr string) ([]string, error) {
+	if len(s.HostKeyFingerprints) > 0 {
+		return nil, nil
+	}
+
+	store := s.KnownHosts
+	switch s.HostKeyCheck {
+	case "", "tofu":
+		if store == "" {
+			store = DefaultTrustedHostsFile
+		}
+		tofuMu.Lock()
+		defer tofuMu.Unlock()
+		if _, err := os.Stat(store); os.IsNotExist(err) {
+			return nil, nil
+		}
+	case "strict":
+	default:
+		return nil, nil
+	}
+
+	cb, err := knownhosts.New(store)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load host key store %s: %v", store, err)
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(cb(addr, &net.TCPAddr{}, probeHostKey), &keyErr) {
+		return nil, nil
+	}
+	var algorithms []string
+	seen := make(map[string]bool)
+	for _, k := range keyErr.Want {
+		for _, algo := range keyAlgorithms(k.Key.Type()) {
+			if !seen[algo] {
+				seen[algo] = true
+				algorithms = append(algorithms, algo)
+			}
+		}
+	}
+	return algorithms, nil
+}
+
+// keyAlgorithms returns the signature algorithms a host key of keyType can
+// be presented with.
+func keyAlgorithms(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
+
+func pinnedHostKey(fingerprints []string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		got := ssh.FingerprintSHA256(key)
+		for _, fp := range fingerprints {
+			if !strings.HasPrefix(fp, "SHA256:") {
+				fp = "SHA256:" + fp
+			}
+			if fp == got {
+				return nil
+			}
+		}
+		return fmt.Errorf("host key mismatch for %s: server presented %s %s, expected one of %s",
+			hostname, key.Type(), got, strings.Join(fingerprints, ", "))
+	}
+}
+
+func tofuHostKey(store string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		tofuMu.Lock()
+		defer tofuMu.Unlock()
+
+		if _, err := os.Stat(store); os.IsNotExist(err) {
+			if dir := filepath.Dir(store); dir != "." {
+				if err := os.MkdirAll(dir, 0700); err != nil {
+					return err
+				}
+			}
+			if err := os.WriteFile(store, nil, 0600); err != nil {
+				return err
+			}
+		}
+
+		cb, err := knownhosts.New(store)
+		if err != nil {
+			return fmt.Errorf("failed to load host key store %s: %v", store, err)
+		}
+
+		err = cb(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+			// First contact: remember the key and refuse any other from now on.
+			f, err := os.OpenFile(store, os.O_APPEND|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+			if _, err := f.WriteString(line + "\n"); err != nil {
+				return err
+			}
+			return nil
+		}
+		return describeHostKeyError(hostname, key, err)
+	}
+}
+
+// describeHostKeyError turns knownhosts errors into a message that says which
+// key was presented and which one was expected.
+func describeHostKeyError(hostname string, key ssh.PublicKey, err error) error {
+	if err == nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return err
+	}
+	got := ssh.FingerprintSHA256(key)
+	if len(keyErr.Want) == 0 {
+		return fmt.Errorf("unknown host key for %s: server presented %s %s", hostname, key.Type(), got)
+	}
+	var want []string
+	for _, k := range keyErr.Want {
+		want = append(want, fmt.Sprintf("%s %s (%s:%d)", k.Key.Type(), ssh.FingerprintSHA256(k.Key), k.Filename, k.Line))
+	}
+	return fmt.Errorf("host key mismatch for %s: server presented %s %s, expected %s",
+		hostname, key.Type(), got, strings.Join(want, ", "))
+}
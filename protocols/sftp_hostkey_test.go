@@ -0,0 +1,169 @@
+package protocols
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// newTestSSHServer serves SFTP with the given host keys to user "u" with
+// password "p" and returns its port.
+func newTestSSHServer(t *testing.T, hostKeys ...ssh.Signer) int {
+	t.Helper()
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == "u" && string(pass) == "p" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("denied")
+		},
+	}
+	for _, k := range hostKeys {
+		config.AddHostKey(k)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(nc, config)
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func serveSFTP(nc net.Conn, config *ssh.ServerConfig) {
+	defer nc.Close()
+	conn, chans, reqs, err := ssh.NewServerConn(nc, config)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	go ssh.DiscardRequests(reqs)
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			nch.Reject(ssh.UnknownChannelType, "session only")
+			continue
+		}
+		ch, requests, err := nch.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					if server, err := sftp.NewServer(ch); err == nil {
+						go func() {
+							server.Serve()
+							ch.Close()
+						}()
+					}
+				}
+			}
+		}()
+	}
+}
+
+func testSigner(t *testing.T, keyType string) ssh.Signer {
+	t.Helper()
+	var key any
+	var err error
+	switch keyType {
+	case "ed25519":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case "ecdsa":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestHostKeyAlgorithmsFollowKnownHosts(t *testing.T) {
+	ecdsaKey, ed25519Key, rsaKey := testSigner(t, "ecdsa"), testSigner(t, "ed25519"), testSigner(t, "rsa")
+	port := newTestSSHServer(t, ecdsaKey, ed25519Key, rsaKey)
+	host := knownhosts.Normalize(fmt.Sprintf("127.0.0.1:%d", port))
+
+	tests := []struct {
+		name    string
+		check   string
+		known   []ssh.Signer
+		wantErr string
+	}{
+		{name: "strict, ed25519 on record", check: "strict", known: []ssh.Signer{ed25519Key}},
+		{name: "strict, rsa on record", check: "strict", known: []ssh.Signer{rsaKey}},
+		{name: "strict, ecdsa on record", check: "strict", known: []ssh.Signer{ecdsaKey}},
+		{name: "tofu, ed25519 on record", check: "tofu", known: []ssh.Signer{ed25519Key}},
+		{name: "tofu, first contact", check: "tofu"},
+		{name: "strict, other ed25519 on record", check: "strict", known: []ssh.Signer{testSigner(t, "ed25519")},
+			wantErr: "host key mismatch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := filepath.Join(t.TempDir(), "known_hosts")
+			if tt.known != nil {
+				var lines []string
+				for _, k := range tt.known {
+					lines = append(lines, knownhosts.Line([]string{host}, k.PublicKey()))
+				}
+				if err := os.WriteFile(store, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			fs := &SFTPFileSystem{
+				Host: "127.0.0.1", Port: port, User: "u", Password: "p", RootPath: "/",
+				AuthMethods: []string{"password"}, HostKeyCheck: tt.check, KnownHosts: store,
+			}
+			err := fs.Init(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Init: %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Init: %v", err)
+			}
+			fs.Close()
+		})
+	}
+}
+
+func TestKeyAlgorithms(t *testing.T) {
+	if got := keyAlgorithms(ssh.KeyAlgoRSA); len(got) != 3 || got[0] != ssh.KeyAlgoRSASHA512 || got[2] != ssh.KeyAlgoRSA {
+		t.Errorf("ssh-rsa: %v", got)
+	}
+	if got := keyAlgorithms(ssh.KeyAlgoED25519); len(got) != 1 || got[0] != ssh.KeyAlgoED25519 {
+		t.Errorf("ssh-ed25519: %v", got)
+	}
+}
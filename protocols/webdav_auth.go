@@ -0,0 +1,180 @@
+package protocols
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/studio-b12/gowebdav"
+)
+
+// basicAuth sends HTTP basic credentials with every request.
+type basicAuth struct {
+	user     string
+	password string
+}
+
+func (b *basicAuth) Authorize(c *http.Client, rq *http.Request, path string) error {
+	if b.user != "" || b.password != "" {
+		rq.SetBasicAuth(b.user, b.password)
+	}
+	return nil
+}
+
+func (b *basicAuth) Verify(c *http.Client, rs *http.Response, path string) (bool, error) {
+	if rs.StatusCode == http.StatusUnauthorized {
+		return false, gowebdav.NewPathError("Authorize", path, rs.StatusCode)
+	}
+	return false, nil
+}
+
+func (b *basicAuth) Clone() gowebdav.Authenticator { return b }
+
+func (b *basicAuth) Close() error { return nil }
+
+// digestAuth implements RFC 7616 digest authentication against a challenge
+// obtained up front. The state is shared by all clones so the nonce count
+// keeps increasing across requests.
+type digestAuth struct {
+	user     string
+	password string
+	state    *digestState
+}
+
+type digestState struct {
+	mu     sync.Mutex
+	params map[string]string
+	nc     int
+}
+
+func newDigestAuth(user, password, challenge string) *digestAuth {
+	return &digestAuth{
+		user:     user,
+		password: password,
+		state:    &digestState{params: parseDigestChallenge(challenge)},
+	}
+}
+
+func (d *digestAuth) Authorize(c *http.Client, rq *http.Request, path string) error {
+	d.state.mu.Lock()
+	d.state.nc++
+	nc := fmt.Sprintf("%08x", d.state.nc)
+	p := d.state.params
+	realm, nonce, opaque, algorithm := p["realm"], p["nonce"], p["opaque"], p["algorithm"]
+	qop := ""
+	for _, q := range strings.Split(p["qop"], ",") {
+		if strings.TrimSpace(q) == "auth" {
+			qop = "auth"
+		}
+	}
+	d.state.mu.Unlock()
+
+	var newHash func() hash.Hash
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return fmt.Errorf("unsupported digest algorithm: %s", algorithm)
+	}
+	h := func(s string) string {
+		sum := newHash()
+		sum.Write([]byte(s))
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+
+	cnonceBytes := make([]byte, 8)
+	rand.Read(cnonceBytes)
+	cnonce := hex.EncodeToString(cnonceBytes)
+
+	uri := rq.URL.RequestURI()
+	ha1 := h(d.user + ":" + realm + ":" + d.password)
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		ha1 = h(ha1 + ":" + nonce + ":" + cnonce)
+	}
+	ha2 := h(rq.Method + ":" + uri)
+
+	var response string
+	if qop != "" {
+		response = h(strings.Join([]string{ha1, nonce, nc, cnonce, qop, ha2}, ":"))
+	} else {
+		response = h(ha1 + ":" + nonce + ":" + ha2)
+	}
+
+	header := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`,
+		d.user, realm, nonce, uri, response)
+	if algorithm != "" {
+		header += ", algorithm=" + algorithm
+	}
+	if opaque != "" {
+		header += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	if qop != "" {
+		header += fmt.Sprintf(`, qop=%s, nc=%s, cnonce="%s"`, qop, nc, cnonce)
+	}
+	rq.Header.Set("Authorization", header)
+	return nil
+}
+
+func (d *digestAuth) Verify(c *http.Client, rs *http.Response, path string) (bool, error) {
+	if rs.StatusCode != http.StatusUnauthorized {
+		return false, nil
+	}
+	// A stale nonce only affects this request; pick up the new one so the
+	// following requests succeed. Bodies are streamed and cannot be replayed.
+	for _, challenge := range rs.Header.Values("Www-Authenticate") {
+		params := parseDigestChallenge(challenge)
+		if strings.EqualFold(params["stale"], "true") {
+			d.state.mu.Lock()
+			d.state.params = params
+			d.state.nc = 0
+			d.state.mu.Unlock()
+		}
+	}
+	return false, gowebdav.NewPathError("Authorize", path, rs.StatusCode)
+}
+
+func (d *digestAuth) Clone() gowebdav.Authenticator { return d }
+
+func (d *digestAuth) Close() error { return nil }
+
+// parseDigestChallenge splits `Digest realm="x", nonce="y", qop="auth"`
+// into its parameters, honouring commas inside quoted values.
+func parseDigestChallenge(challenge string) map[string]string {
+	params := make(map[string]string)
+	if i := strings.IndexByte(challenge, ' '); i >= 0 {
+		challenge = challenge[i+1:]
+	}
+
+	var parts []string
+	inQuotes := false
+	start := 0
+	for i, r := range challenge {
+		switch r {
+		case '"':
+			inQuotes = !inQuotes
+		case ',':
+			if !inQuotes {
+				parts = append(parts, challenge[start:i])
+				start = i + 1
+			}
+		}
+	}
+	parts = append(parts, challenge[start:])
+
+	for _, part := range parts {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+	}
+	return params
+}
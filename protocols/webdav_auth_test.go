@@ -0,0 +1,33 @@
+package protocols
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDigestChallenge(t *testing.T) {
+	tests := []struct {
+		challenge string
+		want      map[string]string
+	}{
+		{
+			`Digest realm="dav", nonce="abc", qop="auth"`,
+			map[string]string{"realm": "dav", "nonce": "abc", "qop": "auth"},
+		},
+		{
+			`Digest realm="a, b", qop="auth,auth-int", algorithm=SHA-256, stale=TRUE`,
+			map[string]string{"realm": "a, b", "qop": "auth,auth-int", "algorithm": "SHA-256", "stale": "TRUE"},
+		},
+		{
+			`Digest Realm="x",Nonce="n=1",  opaque="o"`,
+			map[string]string{"realm": "x", "nonce": "n=1", "opaque": "o"},
+		},
+		{`Digest`, map[string]string{}},
+		{`Digest realm="x", broken`, map[string]string{"realm": "x"}},
+	}
+	for _, tt := range tests {
+		if got := parseDigestChallenge(tt.challenge); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseDigestChallenge(%q) = %v, want %v", tt.challenge, got, tt.want)
+		}
+	}
+}